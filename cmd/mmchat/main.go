@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"flag"
 	"fmt"
 	"log"
@@ -12,6 +13,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/ageniuscoder/mmchat/backend/internal/attachments"
 	"github.com/ageniuscoder/mmchat/backend/internal/auth"
 	"github.com/ageniuscoder/mmchat/backend/internal/chat"
 	"github.com/ageniuscoder/mmchat/backend/internal/config"
@@ -49,28 +51,81 @@ func main() {
 		slog.Info("Migration Completed")
 		return
 	}
+	//blob storage for attachments
+	blobs, err := attachments.NewLocalStore(cfg.AttachmentsDir)
+	if err != nil {
+		log.Fatalf("Error preparing attachments dir: %v", err)
+	}
 	//ws hub
 	hub := chat.NewHub(conn.Db)
+	hub.EventRetention = time.Duration(cfg.EventRetentionHours) * time.Hour
+	switch cfg.Broker {
+	case "memory":
+	case "postgres":
+		broker, err := chat.NewPostgresBroker(conn.Db, cfg.PostgresDSN)
+		if err != nil {
+			log.Fatalf("Error starting postgres broker: %v", err)
+		}
+		defer broker.Close()
+		hub.Broker = broker
+	default:
+		log.Fatalf("Unknown BROKER %q (want memory or postgres)", cfg.Broker)
+	}
 	go hub.Run()
 
 	//http server connection
-	r := gin.Default()
+	// gin.Default's logger would print ?token= access tokens
+	r := gin.New()
+	r.Use(auth.RequestLogger(), gin.Recovery())
+	// ClientIP feeds login throttling and session records, so only believe
+	// X-Forwarded-For from configured proxies
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 	r.Use(auth.CorsMiddleware())
 	api := r.Group("/api")
 
+	//sessions back access tokens so devices can be signed out
+	tokenSources, err := auth.ParseSources(cfg.AuthTokenSources)
+	if err != nil {
+		log.Fatalf("Invalid AUTH_TOKEN_SOURCES: %v", err)
+	}
+	sessions := &auth.Sessions{
+		DB:         conn.Db,
+		Secret:     cfg.JWTSecret,
+		AccessTTL:  time.Duration(cfg.JWTTTLMin) * time.Minute,
+		RefreshTTL: time.Duration(cfg.RefreshTTLDays) * 24 * time.Hour,
+		Sources:    tokenSources,
+		OnRevoke:   hub.CloseSession,
+	}
+
 	//public routes
-	users.RegisterPublic(api, conn.Db, cfg)
+	users.RegisterPublic(api, conn.Db, cfg, sessions)
 
 	//protected routes
-	authMidl := auth.JWTMiddleware(cfg.JWTSecret)
+	authMidl := auth.JWTMiddleware(sessions)
 	priv := api.Group("")
 	priv.Use(authMidl)
-	chat.RegisterWS(priv, hub, cfg.JWTSecret)
-	profile.Register(priv, conn.Db)
+	users.Register(priv, conn.Db, cfg, sessions)
+	chat.RegisterWS(priv, hub)
+	profile.Register(priv, conn.Db, hub)
 	conversations.Register(priv, conn.Db, hub)
-	messages.Register(priv, conn.Db, hub)
+	hub.Messages = messages.Register(priv, conn.Db, hub, cfg)
+	attachments.Register(priv, conn.Db, blobs, cfg)
 	feature.Register(priv, conn.Db)
 
+	//metrics (hub cache hits/misses etc.) on a separate, non-public listener
+	if cfg.DebugAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/debug/vars", expvar.Handler())
+		go func() {
+			log.Printf("debug vars on %s/debug/vars", cfg.DebugAddr)
+			if err := http.ListenAndServe(cfg.DebugAddr, mux); err != nil {
+				log.Printf("debug listener stopped: %v", err)
+			}
+		}()
+	}
+
 	/////////
 	srv := &http.Server{Addr: cfg.Addr, Handler: r}
 	go func() {
@@ -0,0 +1,331 @@
+package attachments
+
+import (
+	"bytes"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/chat"
+	"github.com/ageniuscoder/mmchat/backend/internal/config"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/gin-gonic/gin"
+)
+
+// allowedTypes lists the sniffed MIME types accepted for upload.
+var allowedTypes = map[string]bool{
+	"image/jpeg":      true,
+	"image/png":       true,
+	"image/gif":       true,
+	"image/webp":      true,
+	"application/pdf": true,
+	"text/plain":      true,
+	"audio/mpeg":      true,
+	"audio/wave":      true,
+	"video/mp4":       true,
+	"video/webm":      true,
+	"application/zip": true,
+}
+
+type Service struct {
+	DB       *sql.DB
+	Store    BlobStore
+	MaxBytes int64
+	// MaxUnclaimed caps how many uploads a user may hold that are not yet
+	// part of a message; UnclaimedTTL is how long such uploads are kept.
+	MaxUnclaimed int
+	UnclaimedTTL time.Duration
+}
+
+func Register(rg *gin.RouterGroup, db *sql.DB, store BlobStore, cfg config.Config) {
+	s := Service{
+		DB:           db,
+		Store:        store,
+		MaxBytes:     int64(cfg.AttachmentMaxMB) << 20,
+		MaxUnclaimed: cfg.AttachmentMaxUnclaimed,
+		UnclaimedTTL: time.Duration(cfg.AttachmentUnclaimedTTLMin) * time.Minute,
+	}
+	if s.UnclaimedTTL > 0 {
+		go s.sweepLoop()
+	}
+	rg.POST("/attachments", s.upload) //?conversation_id=
+	rg.GET("/attachments/:id", s.download)
+	rg.GET("/attachments/:id/thumbnail", s.thumbnail)
+}
+
+// upload streams the multipart "file" part straight into the blob store. The
+// attachment stays unlinked until a message is sent with its id.
+func (s Service) upload(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Query("conversation_id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "conversation_id is required")
+		return
+	}
+
+	var n int
+	_ = s.DB.QueryRow(`SELECT COUNT(1) FROM participants WHERE conversation_id=$1 AND user_id=$2`, cid, uid).Scan(&n)
+	if n == 0 {
+		httpx.Err(c, http.StatusForbidden, "not a participant")
+		return
+	}
+	if s.MaxUnclaimed > 0 {
+		var pending int
+		_ = s.DB.QueryRow(`SELECT COUNT(1) FROM attachments WHERE uploader_id=$1 AND message_id IS NULL`, uid).Scan(&pending)
+		if pending >= s.MaxUnclaimed {
+			httpx.Err(c, http.StatusTooManyRequests, "too many unsent attachments")
+			return
+		}
+	}
+
+	// leave headroom for multipart framing around the file itself
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, s.MaxBytes+1<<20)
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "multipart form expected")
+		return
+	}
+	var part io.Reader
+	var fileName string
+	for {
+		p, err := mr.NextPart()
+		if err != nil {
+			httpx.Err(c, http.StatusBadRequest, "file part is required")
+			return
+		}
+		if p.FormName() == "file" {
+			part, fileName = p, filepath.Base(p.FileName())
+			break
+		}
+	}
+	if fileName == "." || fileName == "/" {
+		fileName = "file"
+	}
+
+	head := make([]byte, 512)
+	hn, err := io.ReadFull(part, head)
+	if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, io.EOF) {
+		httpx.Err(c, http.StatusBadRequest, "failed to read upload")
+		return
+	}
+	head = head[:hn]
+	mimeType, _, _ := mime.ParseMediaType(http.DetectContentType(head))
+	if !allowedTypes[mimeType] {
+		httpx.Err(c, http.StatusUnsupportedMediaType, "file type not allowed")
+		return
+	}
+
+	key := newKey()
+	body := &io.LimitedReader{R: io.MultiReader(bytes.NewReader(head), part), N: s.MaxBytes + 1}
+	size, err := s.Store.Put(c, key, body)
+	if err != nil || size > s.MaxBytes {
+		_ = s.Store.Delete(c, key)
+		var mbe *http.MaxBytesError
+		if size > s.MaxBytes || errors.As(err, &mbe) {
+			httpx.Err(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("file exceeds %d bytes", s.MaxBytes))
+			return
+		}
+		httpx.Err(c, http.StatusInternalServerError, "failed to store file")
+		return
+	}
+
+	var thumbKey sql.NullString
+	var width, height sql.NullInt64
+	if thumbnailable(mimeType) {
+		if tk, w, h, err := s.storeThumbnail(c, key); err == nil {
+			thumbKey = sql.NullString{String: tk, Valid: true}
+			width = sql.NullInt64{Int64: int64(w), Valid: true}
+			height = sql.NullInt64{Int64: int64(h), Valid: true}
+		} else {
+			fmt.Printf("upload: thumbnail for %s failed: %v\n", key, err)
+		}
+	}
+
+	var id int64
+	err = s.DB.QueryRow(`
+		INSERT INTO attachments (conversation_id, uploader_id, storage_key, thumbnail_key, file_name, mime_type, size_bytes, width, height)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`,
+		cid, uid, key, thumbKey, fileName, mimeType, size, width, height).Scan(&id)
+	if err != nil {
+		_ = s.Store.Delete(c, key)
+		if thumbKey.Valid {
+			_ = s.Store.Delete(c, thumbKey.String)
+		}
+		httpx.Err(c, http.StatusInternalServerError, "failed to save attachment")
+		return
+	}
+
+	httpx.OK(c, gin.H{"success": true, "attachment": meta(id, fileName, mimeType, size, width, height, thumbKey.Valid)})
+}
+
+func (s Service) storeThumbnail(c *gin.Context, key string) (string, int, int, error) {
+	rc, err := s.Store.Open(c, key)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	b, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return "", 0, 0, err
+	}
+	thumb, w, h, err := makeThumbnail(bytes.NewReader(b))
+	if err != nil {
+		return "", 0, 0, err
+	}
+	tk := key + ".thumb.jpg"
+	if _, err := s.Store.Put(c, tk, bytes.NewReader(thumb)); err != nil {
+		return "", 0, 0, err
+	}
+	return tk, w, h, nil
+}
+
+func (s Service) download(c *gin.Context) {
+	s.serve(c, false)
+}
+
+func (s Service) thumbnail(c *gin.Context) {
+	s.serve(c, true)
+}
+
+// serve streams an attachment (or its thumbnail) to a participant of the
+// conversation it was uploaded to. Until it is sent, only its uploader may
+// fetch it.
+func (s Service) serve(c *gin.Context, thumb bool) {
+	uid := auth.MustUserID(c)
+	id, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid attachment id")
+		return
+	}
+
+	var key, fileName, mimeType string
+	var thumbKey sql.NullString
+	var size int64
+	err = s.DB.QueryRow(`
+		SELECT a.storage_key, a.thumbnail_key, a.file_name, a.mime_type, a.size_bytes
+		FROM attachments a
+		JOIN participants p ON p.conversation_id = a.conversation_id AND p.user_id = $2
+		LEFT JOIN messages m ON m.id = a.message_id
+		WHERE a.id = $1
+		AND ((m.id IS NULL AND a.uploader_id = $2) OR (m.id IS NOT NULL AND m.is_deleted = FALSE))`, id, uid).Scan(&key, &thumbKey, &fileName, &mimeType, &size)
+	if err != nil {
+		httpx.Err(c, http.StatusNotFound, "attachment not found")
+		return
+	}
+	if thumb {
+		if !thumbKey.Valid {
+			httpx.Err(c, http.StatusNotFound, "no thumbnail for attachment")
+			return
+		}
+		key, mimeType, size = thumbKey.String, "image/jpeg", -1
+	}
+
+	rc, err := s.Store.Open(c, key)
+	if err != nil {
+		httpx.Err(c, http.StatusNotFound, "attachment not found")
+		return
+	}
+	defer rc.Close()
+
+	disposition := "attachment"
+	if strings.HasPrefix(mimeType, "image/") {
+		disposition = "inline"
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType(disposition, map[string]string{"filename": fileName}))
+	c.Header("X-Content-Type-Options", "nosniff")
+	c.Header("Cache-Control", "private, max-age=86400")
+	c.DataFromReader(http.StatusOK, size, mimeType, rc, nil)
+}
+
+// ForMessages loads the attachments linked to each of the given messages.
+func ForMessages(db *sql.DB, messageIDs []int64) (map[int64][]chat.Attachment, error) {
+	out := make(map[int64][]chat.Attachment)
+	if len(messageIDs) == 0 {
+		return out, nil
+	}
+	ph := make([]string, len(messageIDs))
+	args := make([]any, len(messageIDs))
+	for i, id := range messageIDs {
+		ph[i] = fmt.Sprintf("$%d", i+1)
+		args[i] = id
+	}
+	rows, err := db.Query(`
+		SELECT id, message_id, file_name, mime_type, size_bytes, width, height, thumbnail_key IS NOT NULL
+		FROM attachments
+		WHERE message_id IN (`+strings.Join(ph, ",")+`)
+		ORDER BY id`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var id, mid, size int64
+		var fileName, mimeType string
+		var width, height sql.NullInt64
+		var hasThumb bool
+		if err := rows.Scan(&id, &mid, &fileName, &mimeType, &size, &width, &height, &hasThumb); err != nil {
+			return nil, err
+		}
+		out[mid] = append(out[mid], meta(id, fileName, mimeType, size, width, height, hasThumb))
+	}
+	return out, rows.Err()
+}
+
+// Claim links unlinked uploads of the sender in the given conversation to a
+// freshly inserted message. It fails unless every id could be claimed.
+func Claim(tx *sql.Tx, messageID, conversationID, uploaderID int64, ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	ph := make([]string, len(ids))
+	args := []any{messageID, conversationID, uploaderID}
+	for i, id := range ids {
+		ph[i] = fmt.Sprintf("$%d", i+4)
+		args = append(args, id)
+	}
+	res, err := tx.Exec(`
+		UPDATE attachments SET message_id=$1
+		WHERE conversation_id=$2 AND uploader_id=$3 AND message_id IS NULL
+		AND id IN (`+strings.Join(ph, ",")+`)`, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n != int64(len(ids)) {
+		return errors.New("invalid attachment ids")
+	}
+	return nil
+}
+
+func meta(id int64, fileName, mimeType string, size int64, width, height sql.NullInt64, hasThumb bool) chat.Attachment {
+	a := chat.Attachment{
+		ID:       id,
+		FileName: fileName,
+		MimeType: mimeType,
+		Size:     size,
+		Width:    int(width.Int64),
+		Height:   int(height.Int64),
+		URL:      fmt.Sprintf("/api/attachments/%d", id),
+	}
+	if hasThumb {
+		a.ThumbnailURL = a.URL + "/thumbnail"
+	}
+	return a
+}
+
+// newKey returns a random, date-prefixed blob key.
+func newKey() string {
+	b := make([]byte, 16)
+	_, _ = rand.Read(b)
+	return time.Now().UTC().Format("2006/01/02/") + hex.EncodeToString(b)
+}
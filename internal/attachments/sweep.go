@@ -0,0 +1,57 @@
+package attachments
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// sweepEvery is how often unclaimed uploads are looked for.
+const sweepEvery = 10 * time.Minute
+
+// sweepLoop periodically removes uploads that were never attached to a
+// message within UnclaimedTTL.
+func (s Service) sweepLoop() {
+	t := time.NewTicker(sweepEvery)
+	defer t.Stop()
+	for range t.C {
+		s.sweepUnclaimed(context.Background())
+	}
+}
+
+// sweepUnclaimed deletes expired unclaimed rows first and their blobs after,
+// so a concurrent Claim either wins the row or fails cleanly.
+func (s Service) sweepUnclaimed(ctx context.Context) {
+	rows, err := s.DB.QueryContext(ctx, `
+		DELETE FROM attachments
+		WHERE message_id IS NULL AND created_at < $1
+		RETURNING storage_key, thumbnail_key`, time.Now().Add(-s.UnclaimedTTL))
+	if err != nil {
+		fmt.Println("attachments: sweep failed:", err)
+		return
+	}
+	var keys []string
+	for rows.Next() {
+		var key string
+		var thumb sql.NullString
+		if err := rows.Scan(&key, &thumb); err != nil {
+			fmt.Println("attachments: sweep failed:", err)
+			break
+		}
+		keys = append(keys, key)
+		if thumb.Valid {
+			keys = append(keys, thumb.String)
+		}
+	}
+	rows.Close()
+
+	for _, key := range keys {
+		if err := s.Store.Delete(ctx, key); err != nil {
+			fmt.Printf("attachments: failed to delete blob %s: %v\n", key, err)
+		}
+	}
+	if len(keys) > 0 {
+		fmt.Printf("attachments: swept %d unclaimed blobs\n", len(keys))
+	}
+}
@@ -0,0 +1,71 @@
+package attachments
+
+import (
+	"bytes"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+)
+
+const (
+	thumbMaxSide = 320
+	// maxDecodePixels guards against decompression bombs.
+	maxDecodePixels = 40_000_000
+)
+
+// thumbnailable reports whether we can decode the MIME type with the
+// standard library decoders registered above.
+func thumbnailable(mime string) bool {
+	return mime == "image/jpeg" || mime == "image/png" || mime == "image/gif"
+}
+
+// makeThumbnail decodes an image and returns a JPEG scaled to fit within
+// thumbMaxSide, along with the original dimensions.
+func makeThumbnail(src io.ReadSeeker) (thumb []byte, width, height int, err error) {
+	cfg, _, err := image.DecodeConfig(src)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if cfg.Width*cfg.Height > maxDecodePixels {
+		return nil, cfg.Width, cfg.Height, image.ErrFormat
+	}
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, 0, err
+	}
+	img, _, err := image.Decode(src)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	tw, th := w, h
+	if w > thumbMaxSide || h > thumbMaxSide {
+		if w >= h {
+			tw, th = thumbMaxSide, max(1, h*thumbMaxSide/w)
+		} else {
+			tw, th = max(1, w*thumbMaxSide/h), thumbMaxSide
+		}
+	}
+
+	// nearest-neighbour scale, then flatten onto white since JPEG has no alpha
+	scaled := image.NewRGBA(image.Rect(0, 0, tw, th))
+	for y := 0; y < th; y++ {
+		sy := b.Min.Y + y*h/th
+		for x := 0; x < tw; x++ {
+			scaled.Set(x, y, img.At(b.Min.X+x*w/tw, sy))
+		}
+	}
+	out := image.NewRGBA(scaled.Bounds())
+	draw.Draw(out, out.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(out, out.Bounds(), scaled, image.Point{}, draw.Over)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, out, &jpeg.Options{Quality: 80}); err != nil {
+		return nil, 0, 0, err
+	}
+	return buf.Bytes(), w, h, nil
+}
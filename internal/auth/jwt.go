@@ -9,14 +9,18 @@ import (
 
 type Claims struct {
 	UserId int64 `json:"user_id"`
+	// SessionID ties the access token to a row in sessions so it can be
+	// revoked before it expires.
+	SessionID int64 `json:"sid"`
 	jwt.RegisteredClaims
 }
 
-func NewToken(secret string, userid int64, ttlmin int) (string, error) {
+func NewToken(secret string, userid, sessionid int64, ttl time.Duration) (string, error) {
 	claims := Claims{
-		UserId: userid,
+		UserId:    userid,
+		SessionID: sessionid,
 		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(time.Duration(ttlmin) * time.Minute)),
+			ExpiresAt: jwt.NewNumericDate(time.Now().UTC().Add(ttl)),
 			IssuedAt:  jwt.NewNumericDate(time.Now().UTC()),
 			Issuer:    "mmchat",
 		},
@@ -0,0 +1,57 @@
+package auth
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RequestLogger is gin's default request logger with the ?token= query
+// parameter redacted, so WebSocket upgrades do not write access tokens to
+// the logs.
+func RequestLogger() gin.HandlerFunc {
+	return gin.LoggerWithConfig(gin.LoggerConfig{Formatter: logFormatter})
+}
+
+// logFormatter mirrors gin's default format.
+func logFormatter(param gin.LogFormatterParams) string {
+	var statusColor, methodColor, resetColor string
+	if param.IsOutputColor() {
+		statusColor = param.StatusCodeColor()
+		methodColor = param.MethodColor()
+		resetColor = param.ResetColor()
+	}
+	if param.Latency > time.Minute {
+		param.Latency = param.Latency.Truncate(time.Second)
+	}
+	return fmt.Sprintf("[GIN] %v |%s %3d %s| %13v | %15s |%s %-7s %s %#v\n%s",
+		param.TimeStamp.Format("2006/01/02 - 15:04:05"),
+		statusColor, param.StatusCode, resetColor,
+		param.Latency,
+		param.ClientIP,
+		methodColor, param.Method, resetColor,
+		redactToken(param.Path),
+		param.ErrorMessage,
+	)
+}
+
+// redactToken replaces the value of any token query parameter in path.
+func redactToken(path string) string {
+	p, raw, ok := strings.Cut(path, "?")
+	if !ok {
+		return path
+	}
+	q, err := url.ParseQuery(raw)
+	if err != nil {
+		// cannot tell where the token ends; drop the whole query
+		return p + "?REDACTED"
+	}
+	if !q.Has("token") {
+		return path
+	}
+	q.Set("token", "REDACTED")
+	return p + "?" + q.Encode()
+}
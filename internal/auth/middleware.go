@@ -10,27 +10,38 @@ import (
 
 type ctxKey string
 
-const CtxUserID ctxKey = "uid"
+const (
+	CtxUserID    ctxKey = "uid"
+	CtxSessionID ctxKey = "sid"
+)
 
-func JWTMiddleware(secret string) gin.HandlerFunc {
+// JWTMiddleware accepts access tokens whose session is still active, so a
+// revoked device is locked out without waiting for its token to expire.
+func JWTMiddleware(sessions *Sessions) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		tok, err := c.Cookie("token")
-		if err != nil {
-			if err == http.ErrNoCookie {
-				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing token cookie"})
-				return
-			}
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "cookie read error"})
+		tok, _ := AccessToken(c, sessions.Sources)
+		if tok == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "missing access token"})
 			return
 		}
 
-		claims, err := ParseToken(secret, tok)
-		if err != nil {
+		claims, err := ParseToken(sessions.Secret, tok)
+		if err != nil || claims.SessionID == 0 {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid Token"})
 			return
 		}
+		if err := sessions.Check(claims.UserId, claims.SessionID); err != nil {
+			if err == ErrSessionEnded {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "session revoked"})
+				return
+			}
+			fmt.Println("session check error:", err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "session check failed"})
+			return
+		}
 
 		c.Set(string(CtxUserID), int64(claims.UserId))
+		c.Set(string(CtxSessionID), claims.SessionID)
 		c.Next()
 	}
 }
@@ -46,6 +57,11 @@ func CorsMiddleware() gin.HandlerFunc {
 		}
 
 		origin := c.Request.Header.Get("Origin")
+		// native and CLI clients send no Origin and are not subject to CORS
+		if origin == "" {
+			c.Next()
+			return
+		}
 
 		var isAllowed bool
 		for _, o := range allowedOrigins {
@@ -89,6 +105,16 @@ func UserIDFromContext(c *gin.Context) (int64, error) {
 	return id, nil
 }
 
+// SessionIDFromContext returns the session of the authenticated request.
+func SessionIDFromContext(c *gin.Context) (int64, bool) {
+	v, ok := c.Get(string(CtxSessionID))
+	if !ok {
+		return 0, false
+	}
+	id, ok := v.(int64)
+	return id, ok
+}
+
 // MustUserID is a convenience function that panics. Use UserIDFromContext for safer handling.
 func MustUserID(c *gin.Context) int64 {
 	id, err := UserIDFromContext(c)
@@ -0,0 +1,241 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidRefresh = errors.New("invalid refresh token")
+	// ErrRefreshReused means an already rotated refresh token was presented,
+	// so it has probably leaked; the session is revoked.
+	ErrRefreshReused = errors.New("refresh token reused")
+	ErrSessionEnded  = errors.New("session revoked or expired")
+)
+
+// Sessions issues access tokens bound to a server-side session and rotates
+// the session's refresh token on every use.
+type Sessions struct {
+	DB         *sql.DB
+	Secret     string
+	AccessTTL  time.Duration
+	RefreshTTL time.Duration
+	// Sources lists where access tokens are read from, in order of
+	// precedence; nil means DefaultSources.
+	Sources []TokenSource
+	// OnRevoke, if set, is called after a session is revoked so that
+	// connections authenticated with it can be closed.
+	OnRevoke func(userID, sessionID int64)
+}
+
+// Tokens is the credential pair handed to a client. Refresh has the form
+// "<session id>.<secret>"; only a hash of the secret is stored.
+type Tokens struct {
+	SessionID int64
+	Access    string
+	Refresh   string
+}
+
+// Device describes where a session was started or last refreshed from.
+type Device struct {
+	Name      string
+	IP        string
+	UserAgent string
+}
+
+// Create starts a session for userID and returns its first tokens.
+func (s *Sessions) Create(userID int64, d Device) (Tokens, error) {
+	secret, hash, err := newRefreshSecret()
+	if err != nil {
+		return Tokens{}, err
+	}
+	// forget this user's sessions that can no longer be used
+	if _, err := s.DB.Exec(`DELETE FROM sessions WHERE user_id=$1 AND (expires_at < NOW() OR revoked_at IS NOT NULL)`, userID); err != nil {
+		return Tokens{}, err
+	}
+	var sid int64
+	err = s.DB.QueryRow(`
+		INSERT INTO sessions (user_id, refresh_hash, device_name, ip, user_agent, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6) RETURNING id`,
+		userID, hash, d.Name, d.IP, d.UserAgent, time.Now().Add(s.RefreshTTL)).Scan(&sid)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return s.tokens(userID, sid, secret)
+}
+
+// Rotate exchanges a refresh token for a new pair. The presented token stops
+// working; presenting it again revokes the whole session.
+func (s *Sessions) Rotate(refresh string, d Device) (int64, Tokens, error) {
+	sid, secret, ok := splitRefresh(refresh)
+	if !ok {
+		return 0, Tokens{}, ErrInvalidRefresh
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return 0, Tokens{}, err
+	}
+	defer tx.Rollback()
+
+	var userID int64
+	var current string
+	var previous sql.NullString
+	var live bool
+	err = tx.QueryRow(`
+		SELECT user_id, refresh_hash, prev_refresh_hash, revoked_at IS NULL AND expires_at > NOW()
+		FROM sessions WHERE id=$1 FOR UPDATE`, sid).Scan(&userID, &current, &previous, &live)
+	if err == sql.ErrNoRows {
+		return 0, Tokens{}, ErrInvalidRefresh
+	}
+	if err != nil {
+		return 0, Tokens{}, err
+	}
+	presented := hashSecret(secret)
+	if previous.Valid && equalHash(presented, previous.String) {
+		if _, err := tx.Exec(`UPDATE sessions SET revoked_at=NOW() WHERE id=$1 AND revoked_at IS NULL`, sid); err != nil {
+			return 0, Tokens{}, err
+		}
+		if err := tx.Commit(); err != nil {
+			return 0, Tokens{}, err
+		}
+		s.revoked(userID, sid)
+		return userID, Tokens{SessionID: sid}, ErrRefreshReused
+	}
+	if !equalHash(presented, current) {
+		return 0, Tokens{}, ErrInvalidRefresh
+	}
+	if !live {
+		return 0, Tokens{}, ErrSessionEnded
+	}
+
+	next, hash, err := newRefreshSecret()
+	if err != nil {
+		return 0, Tokens{}, err
+	}
+	_, err = tx.Exec(`
+		UPDATE sessions SET refresh_hash=$1, prev_refresh_hash=$2, ip=$3, user_agent=$4,
+			last_used_at=NOW(), expires_at=$5
+		WHERE id=$6`, hash, current, d.IP, d.UserAgent, time.Now().Add(s.RefreshTTL), sid)
+	if err != nil {
+		return 0, Tokens{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, Tokens{}, err
+	}
+	t, err := s.tokens(userID, sid, next)
+	return userID, t, err
+}
+
+// Revoke ends one of userID's sessions and reports whether it was active.
+func (s *Sessions) Revoke(userID, sessionID int64) (bool, error) {
+	res, err := s.DB.Exec(`UPDATE sessions SET revoked_at=NOW() WHERE id=$1 AND user_id=$2 AND revoked_at IS NULL`, sessionID, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if n > 0 {
+		s.revoked(userID, sessionID)
+	}
+	return n > 0, err
+}
+
+// RevokeAll ends every active session of userID, e.g. after its password
+// changed, and returns how many there were.
+func (s *Sessions) RevokeAll(userID int64) (int, error) {
+	rows, err := s.DB.Query(`UPDATE sessions SET revoked_at=NOW() WHERE user_id=$1 AND revoked_at IS NULL RETURNING id`, userID)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	var ids []int64
+	for rows.Next() {
+		var sid int64
+		if err := rows.Scan(&sid); err != nil {
+			return 0, err
+		}
+		ids = append(ids, sid)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, sid := range ids {
+		s.revoked(userID, sid)
+	}
+	return len(ids), nil
+}
+
+func (s *Sessions) revoked(userID, sessionID int64) {
+	if s.OnRevoke != nil {
+		s.OnRevoke(userID, sessionID)
+	}
+}
+
+// Check returns ErrSessionEnded unless the session is still usable.
+func (s *Sessions) Check(userID, sessionID int64) error {
+	var live bool
+	err := s.DB.QueryRow(`SELECT revoked_at IS NULL AND expires_at > NOW() FROM sessions WHERE id=$1 AND user_id=$2`, sessionID, userID).Scan(&live)
+	if err == sql.ErrNoRows || (err == nil && !live) {
+		return ErrSessionEnded
+	}
+	return err
+}
+
+// SessionOf returns the session a refresh token belongs to, if the token is
+// current. It does not rotate anything.
+func (s *Sessions) SessionOf(refresh string) (userID, sessionID int64, err error) {
+	sid, secret, ok := splitRefresh(refresh)
+	if !ok {
+		return 0, 0, ErrInvalidRefresh
+	}
+	var hash string
+	if err := s.DB.QueryRow(`SELECT user_id, refresh_hash FROM sessions WHERE id=$1`, sid).Scan(&userID, &hash); err != nil {
+		return 0, 0, ErrInvalidRefresh
+	}
+	if !equalHash(hashSecret(secret), hash) {
+		return 0, 0, ErrInvalidRefresh
+	}
+	return userID, sid, nil
+}
+
+func (s *Sessions) tokens(userID, sid int64, secret string) (Tokens, error) {
+	access, err := NewToken(s.Secret, userID, sid, s.AccessTTL)
+	if err != nil {
+		return Tokens{}, err
+	}
+	return Tokens{SessionID: sid, Access: access, Refresh: strconv.FormatInt(sid, 10) + "." + secret}, nil
+}
+
+func newRefreshSecret() (secret, hash string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	secret = base64.RawURLEncoding.EncodeToString(b)
+	return secret, hashSecret(secret), nil
+}
+
+func hashSecret(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+func equalHash(a, b string) bool {
+	return subtle.ConstantTimeCompare([]byte(a), []byte(b)) == 1
+}
+
+func splitRefresh(refresh string) (int64, string, bool) {
+	id, secret, ok := strings.Cut(refresh, ".")
+	if !ok || secret == "" {
+		return 0, "", false
+	}
+	sid, err := strconv.ParseInt(id, 10, 64)
+	return sid, secret, err == nil
+}
@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// TokenSource is a place an access token may be read from.
+type TokenSource string
+
+const (
+	// FromHeader reads "Authorization: Bearer <token>".
+	FromHeader TokenSource = "header"
+	FromCookie TokenSource = "cookie"
+	// FromQuery reads ?token=; it is only honoured on WebSocket upgrades,
+	// where browsers cannot set headers.
+	FromQuery TokenSource = "query"
+)
+
+// DefaultSources is the precedence used when none is configured.
+var DefaultSources = []TokenSource{FromHeader, FromCookie, FromQuery}
+
+// ParseSources reads a comma separated precedence list such as
+// "header,cookie,query".
+func ParseSources(list string) ([]TokenSource, error) {
+	var sources []TokenSource
+	seen := map[TokenSource]bool{}
+	for _, part := range strings.Split(list, ",") {
+		src := TokenSource(strings.ToLower(strings.TrimSpace(part)))
+		switch src {
+		case "":
+			continue
+		case FromHeader, FromCookie, FromQuery:
+		default:
+			return nil, fmt.Errorf("unknown token source %q (want header, cookie or query)", part)
+		}
+		if !seen[src] {
+			seen[src] = true
+			sources = append(sources, src)
+		}
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no token sources configured")
+	}
+	return sources, nil
+}
+
+// AccessToken returns the token from the first source in sources that
+// carries one. A token that is present but invalid does not fall through to
+// the next source.
+func AccessToken(c *gin.Context, sources []TokenSource) (string, TokenSource) {
+	if sources == nil {
+		sources = DefaultSources
+	}
+	for _, src := range sources {
+		var tok string
+		switch src {
+		case FromHeader:
+			scheme, value, ok := strings.Cut(c.GetHeader("Authorization"), " ")
+			if ok && strings.EqualFold(scheme, "Bearer") {
+				tok = strings.TrimSpace(value)
+			}
+		case FromCookie:
+			tok, _ = c.Cookie("token")
+		case FromQuery:
+			if isWebSocketUpgrade(c) {
+				tok = c.Query("token")
+			}
+		}
+		if tok != "" {
+			return tok, src
+		}
+	}
+	return "", ""
+}
+
+func isWebSocketUpgrade(c *gin.Context) bool {
+	return c.Request.Method == "GET" &&
+		strings.EqualFold(c.GetHeader("Upgrade"), "websocket") &&
+		strings.Contains(strings.ToLower(c.GetHeader("Connection")), "upgrade")
+}
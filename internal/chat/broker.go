@@ -0,0 +1,87 @@
+package chat
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Delivery is one payload bound for every connection of a user.
+type Delivery struct {
+	UserID  int64           `json:"u"`
+	Seq     int64           `json:"s,omitempty"`
+	Payload json.RawMessage `json:"p"`
+}
+
+// Event is what hubs exchange through a Broker.
+type Event struct {
+	Deliveries []Delivery `json:"d,omitempty"`
+	// cache entries every hub must drop
+	InvalidConversations []int64 `json:"ic,omitempty"`
+	InvalidUsers         []int64 `json:"iu,omitempty"`
+	// sessions whose connections every hub must close
+	ClosedSessions []SessionRef `json:"cs,omitempty"`
+}
+
+// SessionRef names one login session of a user.
+type SessionRef struct {
+	UserID    int64 `json:"u"`
+	SessionID int64 `json:"s"`
+}
+
+// Broker carries hub events between server instances and tracks which users
+// are connected anywhere.
+type Broker interface {
+	// Publish sends ev to every hub subscribed to the broker, including the
+	// publishing one.
+	Publish(ev Event) error
+	// Subscribe returns the stream of published events. It is called once,
+	// by Hub.Run.
+	Subscribe() <-chan Event
+	// Connected records that userID now has connections on this node and
+	// reports whether the user was offline on every node before.
+	Connected(userID int64) (first bool, err error)
+	// Disconnected records that userID has no connections left on this
+	// node and reports whether the user is now offline on every node.
+	Disconnected(userID int64) (last bool, err error)
+	Close() error
+}
+
+// MemoryBroker is the single-process Broker used when only one instance runs.
+type MemoryBroker struct {
+	events chan Event
+
+	mu     sync.Mutex
+	online map[int64]bool
+}
+
+func NewMemoryBroker() *MemoryBroker {
+	return &MemoryBroker{
+		events: make(chan Event, 256),
+		online: make(map[int64]bool),
+	}
+}
+
+func (b *MemoryBroker) Publish(ev Event) error {
+	b.events <- ev
+	return nil
+}
+
+func (b *MemoryBroker) Subscribe() <-chan Event { return b.events }
+
+func (b *MemoryBroker) Connected(userID int64) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	first := !b.online[userID]
+	b.online[userID] = true
+	return first, nil
+}
+
+func (b *MemoryBroker) Disconnected(userID int64) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	last := b.online[userID]
+	delete(b.online, userID)
+	return last, nil
+}
+
+func (b *MemoryBroker) Close() error { return nil }
@@ -0,0 +1,202 @@
+package chat
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	notifyChannel = "mmchat_events"
+	// maxNotifyBytes keeps payloads under Postgres' 8000 byte NOTIFY limit;
+	// larger events are spilled to broker_spill and only their id is sent.
+	maxNotifyBytes = 7500
+	spillPrefix    = "@"
+
+	heartbeatEvery = 10 * time.Second
+	// nodeTimeout is how long a node may miss heartbeats before its
+	// presence rows are dropped.
+	nodeTimeout = 30 * time.Second
+	spillTTL    = 5 * time.Minute
+)
+
+// PostgresBroker fans events out to every instance through LISTEN/NOTIFY and
+// aggregates presence in the broker_nodes/broker_presence tables.
+type PostgresBroker struct {
+	db       *sql.DB
+	listener *pq.Listener
+	node     string
+	events   chan Event
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewPostgresBroker registers this instance as a node and starts listening.
+// dsn must point at the same database as db.
+func NewPostgresBroker(db *sql.DB, dsn string) (*PostgresBroker, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return nil, err
+	}
+	b := &PostgresBroker{
+		db:     db,
+		node:   hex.EncodeToString(id),
+		events: make(chan Event, 256),
+		done:   make(chan struct{}),
+	}
+	if _, err := db.Exec(`INSERT INTO broker_nodes (node_id) VALUES ($1)`, b.node); err != nil {
+		return nil, fmt.Errorf("register broker node: %w", err)
+	}
+
+	b.listener = pq.NewListener(dsn, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("[broker] listener: %v", err)
+		}
+	})
+	if err := b.listener.Listen(notifyChannel); err != nil {
+		b.listener.Close()
+		return nil, fmt.Errorf("listen %s: %w", notifyChannel, err)
+	}
+
+	go b.listen()
+	go b.heartbeat()
+	log.Printf("[broker] node %s listening on %s", b.node, notifyChannel)
+	return b, nil
+}
+
+func (b *PostgresBroker) Publish(ev Event) error {
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	msg := string(raw)
+	if len(msg) > maxNotifyBytes {
+		var id int64
+		if err := b.db.QueryRow(`INSERT INTO broker_spill (payload) VALUES ($1) RETURNING id`, msg).Scan(&id); err != nil {
+			return fmt.Errorf("spill event: %w", err)
+		}
+		msg = spillPrefix + strconv.FormatInt(id, 10)
+	}
+	_, err = b.db.Exec(`SELECT pg_notify($1, $2)`, notifyChannel, msg)
+	return err
+}
+
+func (b *PostgresBroker) Subscribe() <-chan Event { return b.events }
+
+// Connected and Disconnected hold a per-user advisory lock so that two nodes
+// racing on the same user agree on who saw the first/last connection.
+func (b *PostgresBroker) Connected(userID int64) (bool, error) {
+	others, err := b.presence(userID, `INSERT INTO broker_presence (node_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`)
+	return others == 0, err
+}
+
+func (b *PostgresBroker) Disconnected(userID int64) (bool, error) {
+	others, err := b.presence(userID, `DELETE FROM broker_presence WHERE node_id=$1 AND user_id=$2`)
+	return others == 0, err
+}
+
+// presence applies change to this node's row for userID and returns how many
+// other nodes hold the user.
+func (b *PostgresBroker) presence(userID int64, change string) (int, error) {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, userID); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(change, b.node, userID); err != nil {
+		return 0, err
+	}
+	var others int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM broker_presence WHERE user_id=$1 AND node_id<>$2`, userID, b.node).Scan(&others); err != nil {
+		return 0, err
+	}
+	return others, tx.Commit()
+}
+
+func (b *PostgresBroker) Close() error {
+	b.closeOnce.Do(func() {
+		close(b.done)
+		b.listener.Close()
+		if _, err := b.db.Exec(`DELETE FROM broker_nodes WHERE node_id=$1`, b.node); err != nil {
+			log.Printf("[broker] failed to deregister node %s: %v", b.node, err)
+		}
+	})
+	return nil
+}
+
+func (b *PostgresBroker) listen() {
+	for {
+		select {
+		case n := <-b.listener.Notify:
+			if n == nil {
+				// the connection was re-established; anything sent meanwhile
+				// is lost for live delivery but still in the event log
+				log.Printf("[broker] listener reconnected")
+				continue
+			}
+			ev, err := b.decode(n.Extra)
+			if err != nil {
+				log.Printf("[broker] dropping event: %v", err)
+				continue
+			}
+			select {
+			case b.events <- ev:
+			case <-b.done:
+				return
+			}
+		case <-time.After(90 * time.Second):
+			go b.listener.Ping()
+		case <-b.done:
+			return
+		}
+	}
+}
+
+func (b *PostgresBroker) decode(msg string) (Event, error) {
+	if id, ok := strings.CutPrefix(msg, spillPrefix); ok {
+		if err := b.db.QueryRow(`SELECT payload FROM broker_spill WHERE id=$1`, id).Scan(&msg); err != nil {
+			return Event{}, fmt.Errorf("load spilled event %s: %w", id, err)
+		}
+	}
+	var ev Event
+	err := json.Unmarshal([]byte(msg), &ev)
+	return ev, err
+}
+
+// heartbeat keeps this node alive and reaps nodes (and their presence) that
+// stopped beating, along with old spilled payloads.
+func (b *PostgresBroker) heartbeat() {
+	t := time.NewTicker(heartbeatEvery)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if _, err := b.db.Exec(`
+				INSERT INTO broker_nodes (node_id) VALUES ($1)
+				ON CONFLICT (node_id) DO UPDATE SET heartbeat_at=NOW()`, b.node); err != nil {
+				log.Printf("[broker] heartbeat failed: %v", err)
+			}
+			if _, err := b.db.Exec(`DELETE FROM broker_nodes WHERE heartbeat_at < NOW() - make_interval(secs => $1)`, nodeTimeout.Seconds()); err != nil {
+				log.Printf("[broker] failed to reap stale nodes: %v", err)
+			}
+			if _, err := b.db.Exec(`DELETE FROM broker_spill WHERE created_at < NOW() - make_interval(secs => $1)`, spillTTL.Seconds()); err != nil {
+				log.Printf("[broker] failed to clean spilled events: %v", err)
+			}
+		case <-b.done:
+			return
+		}
+	}
+}
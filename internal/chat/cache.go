@@ -0,0 +1,171 @@
+package chat
+
+import (
+	"database/sql"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+)
+
+// cacheStats exposes hit/miss counters under /debug/vars as "hub_cache".
+var cacheStats = expvar.NewMap("hub_cache")
+
+// cache keeps conversation membership (with each member's mute) and
+// usernames so that broadcasts do not query the database for every event. Entries live until invalidated;
+// gen guards against a lookup that raced with an invalidation storing what
+// it read before the change.
+type cache struct {
+	mu        sync.RWMutex
+	gen       uint64
+	members   map[int64]memberSet
+	usernames map[int64]string
+}
+
+type memberSet struct {
+	uids []int64
+	// mutedUntil holds the members that set a mute, expired or not
+	mutedUntil map[int64]time.Time
+}
+
+func newCache() *cache {
+	return &cache{
+		members:   make(map[int64]memberSet),
+		usernames: make(map[int64]string),
+	}
+}
+
+func (c *cache) dropConversation(conversationID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.members, conversationID)
+}
+
+func (c *cache) dropUser(userID int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.gen++
+	delete(c.usernames, userID)
+}
+
+// conversationMembers returns every participant of a conversation. The slice
+// is shared and must not be modified.
+func (h *Hub) conversationMembers(conversationID int64) ([]int64, error) {
+	m, err := h.members(conversationID)
+	return m.uids, err
+}
+
+// mutedIn returns the participants who currently have a conversation muted.
+func (h *Hub) mutedIn(conversationID int64) map[int64]bool {
+	m, err := h.members(conversationID)
+	if err != nil {
+		return nil
+	}
+	now := time.Now()
+	muted := make(map[int64]bool)
+	for uid, until := range m.mutedUntil {
+		if until.After(now) {
+			muted[uid] = true
+		}
+	}
+	return muted
+}
+
+func (h *Hub) members(conversationID int64) (memberSet, error) {
+	h.cache.mu.RLock()
+	m, ok := h.cache.members[conversationID]
+	gen := h.cache.gen
+	h.cache.mu.RUnlock()
+	if ok {
+		cacheStats.Add("members_hits", 1)
+		return m, nil
+	}
+	cacheStats.Add("members_misses", 1)
+
+	rows, err := h.DB.Query(`SELECT user_id, muted_until FROM participants WHERE conversation_id=$1`, conversationID)
+	if err != nil {
+		return memberSet{}, err
+	}
+	defer rows.Close()
+	m.mutedUntil = make(map[int64]time.Time)
+	for rows.Next() {
+		var uid int64
+		var until sql.NullTime
+		if err := rows.Scan(&uid, &until); err != nil {
+			log.Printf("[hub] failed to scan participant: %v", err)
+			continue
+		}
+		m.uids = append(m.uids, uid)
+		if until.Valid {
+			m.mutedUntil[uid] = until.Time
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return memberSet{}, err
+	}
+
+	h.cache.mu.Lock()
+	if h.cache.gen == gen {
+		h.cache.members[conversationID] = m
+	}
+	h.cache.mu.Unlock()
+	return m, nil
+}
+
+// othersIn returns the participants of a conversation except userID.
+func (h *Hub) othersIn(conversationID, userID int64) ([]int64, error) {
+	uids, err := h.conversationMembers(conversationID)
+	if err != nil {
+		return nil, err
+	}
+	others := make([]int64, 0, len(uids))
+	for _, uid := range uids {
+		if uid != userID {
+			others = append(others, uid)
+		}
+	}
+	return others, nil
+}
+
+// username returns a user's name, or "" when it cannot be loaded.
+func (h *Hub) username(userID int64) string {
+	h.cache.mu.RLock()
+	name, ok := h.cache.usernames[userID]
+	gen := h.cache.gen
+	h.cache.mu.RUnlock()
+	if ok {
+		cacheStats.Add("usernames_hits", 1)
+		return name
+	}
+	cacheStats.Add("usernames_misses", 1)
+
+	if err := h.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, userID).Scan(&name); err != nil {
+		return ""
+	}
+	h.cache.mu.Lock()
+	if h.cache.gen == gen {
+		h.cache.usernames[userID] = name
+	}
+	h.cache.mu.Unlock()
+	return name
+}
+
+// InvalidateConversation must be called after participants of a
+// conversation, or their mute settings, change. Other instances are told through the broker.
+func (h *Hub) InvalidateConversation(conversationID int64) {
+	h.cache.dropConversation(conversationID)
+	h.announce(Event{InvalidConversations: []int64{conversationID}})
+}
+
+// InvalidateUser must be called after a user's username changes.
+func (h *Hub) InvalidateUser(userID int64) {
+	h.cache.dropUser(userID)
+	h.announce(Event{InvalidUsers: []int64{userID}})
+}
+
+func (h *Hub) announce(ev Event) {
+	if err := h.Broker.Publish(ev); err != nil {
+		log.Printf("[hub] failed to publish control event: %v", err)
+	}
+}
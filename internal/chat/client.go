@@ -1,7 +1,7 @@
 package chat
 
 import (
-	"encoding/json"
+	"sync"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -12,6 +12,10 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = (pongWait * 9) / 10
 	maxMessageSize = 5120
+
+	// CloseSessionRevoked is the close code sent when the connection's
+	// session is logged out or revoked.
+	CloseSessionRevoked = 4001
 )
 
 type Client struct {
@@ -19,6 +23,80 @@ type Client struct {
 	Conn   *websocket.Conn
 	Send   chan []byte
 	UserID int64
+	// SessionID is the login session the connection was authenticated with.
+	SessionID int64
+
+	// ready is closed once the hub has registered the client.
+	ready chan struct{}
+
+	// mu guards Send against being closed mid-send and the catch-up state.
+	// While catchingUp, live events are held in backlog so that they are
+	// written after the replayed ones (see catchUp).
+	mu         sync.Mutex
+	closed     bool
+	catchingUp bool
+	backlog    []queued
+	overflow   bool
+	// closeCode, when set, is sent in the close frame instead of 1000.
+	closeCode   int
+	closeReason string
+}
+
+type queued struct {
+	seq     int64
+	payload []byte
+}
+
+// deliver queues a live event without blocking. It reports false when the
+// connection cannot keep up and should be dropped.
+func (c *Client) deliver(seq int64, payload []byte) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return true
+	}
+	if c.catchingUp {
+		if len(c.backlog) >= maxBacklog {
+			c.overflow = true
+		} else {
+			c.backlog = append(c.backlog, queued{seq, payload})
+		}
+		return true
+	}
+	select {
+	case c.Send <- payload:
+		return true
+	default:
+		return false
+	}
+}
+
+// revoke records why the connection is being closed. It reports false while
+// the client is catching up; finishCatchUp then closes the connection itself.
+func (c *Client) revoke(code int, reason string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeCode, c.closeReason = code, reason
+	return !c.catchingUp
+}
+
+func (c *Client) closeMessage() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeCode == 0 {
+		return []byte{}
+	}
+	return websocket.FormatCloseMessage(c.closeCode, c.closeReason)
+}
+
+// close ends the write pump. Only the hub's Run loop calls it.
+func (c *Client) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.Send)
+	}
 }
 
 func (c *Client) readPump() {
@@ -39,16 +117,7 @@ func (c *Client) readPump() {
 		}
 		// Update user's last active timestamp
 		c.Hub.DB.Exec(`UPDATE users SET last_active=CURRENT_TIMESTAMP WHERE id=$1`, c.UserID)
-		// Parse incoming event
-		var incoming struct {
-			Type           string `json:"type"`
-			ConversationID int64  `json:"conversation_id"`
-		}
-		if err := json.Unmarshal(msg, &incoming); err == nil {
-			if incoming.Type == "typing_start" || incoming.Type == "typing_stop" {
-				c.Hub.BroadcastTyping(incoming.ConversationID, c.UserID, incoming.Type)
-			}
-		}
+		c.handleFrame(msg)
 	}
 }
 
@@ -63,7 +132,7 @@ func (c *Client) writePump() {
 		case message, ok := <-c.Send:
 			c.Conn.SetWriteDeadline(time.Now().Add(writeWait))
 			if !ok {
-				c.Conn.WriteMessage(websocket.CloseMessage, []byte{})
+				c.Conn.WriteMessage(websocket.CloseMessage, c.closeMessage())
 				return
 			}
 			w, err := c.Conn.NextWriter(websocket.TextMessage)
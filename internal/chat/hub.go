@@ -3,135 +3,448 @@ package chat
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"log"
+	"slices"
+	"strings"
+	"sync"
 	"time"
+
+	"github.com/lib/pq"
 )
 
+// pruneEvery is how often Run trims the event log.
+const pruneEvery = time.Hour
+
 type Hub struct {
 	DB *sql.DB
 
+	// Messages handles send/read/edit frames from clients; nil disables them.
+	Messages MessageService
+	// EventRetention is how long persisted events stay replayable; zero keeps
+	// them forever.
+	EventRetention time.Duration
+
+	// Broker carries events to every instance; set it before Run. NewHub
+	// installs an in-process broker.
+	Broker Broker
+
+	// The registry below is owned by Run; every other goroutine reaches it
+	// through these channels.
 	register   chan *Client
 	unregister chan *Client
 
 	// userID -> set of client connections (handles multi-tab/or mutlti device)
 	clients map[int64]map[*Client]bool
+
+	cache *cache
+
+	// presence holds, per user, whether their first connection opened (true)
+	// or last connection closed (false) on this node since presenceLoop last
+	// looked. Run only records the latest change and signals presenceWake,
+	// so it never waits for presenceLoop.
+	presenceMu   sync.Mutex
+	presence     map[int64]bool
+	presenceWake chan struct{}
+
+	// postgres selects the array forms of the event log statements; other
+	// drivers (SQLite in tests) get IN lists and multi-row VALUES.
+	postgres bool
+
+	// logMu keeps this node's hand-offs of logged events to the broker from
+	// interleaving. Per-user seq order comes from publishMuted's row locks.
+	logMu sync.Mutex
 }
 
 func NewHub(db *sql.DB) *Hub {
+	_, pg := db.Driver().(*pq.Driver)
 	return &Hub{
 		DB:         db,
+		postgres:   pg,
+		Broker:     NewMemoryBroker(),
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		clients:    make(map[int64]map[*Client]bool),
+		cache:      newCache(),
+
+		presence:     make(map[int64]bool),
+		presenceWake: make(chan struct{}, 1),
 	}
 }
 
+// Run owns the client registry. It neither touches the database nor waits on
+// presenceLoop, so a slow query does not hold up delivery.
 func (h *Hub) Run() {
+	prune := time.NewTicker(pruneEvery)
+	defer prune.Stop()
+	events := h.Broker.Subscribe()
+	go h.presenceLoop()
 	for {
 		select {
 		case client := <-h.register:
-			//mark user online
-			h.DB.Exec(`UPDATE users SET last_active=NOW() WHERE id=$1`, client.UserID)
-			if h.clients[client.UserID] == nil {
-				h.clients[client.UserID] = make(map[*Client]bool)
+			set := h.clients[client.UserID]
+			if set == nil {
+				set = make(map[*Client]bool)
+				h.clients[client.UserID] = set
+			}
+			set[client] = true
+			if client.ready != nil {
+				close(client.ready)
+			}
+			if len(set) == 1 {
+				h.setPresence(client.UserID, true)
 			}
-			h.clients[client.UserID][client] = true
-
-			// Broadcast online presence
-			h.BroadcastPresence(client.UserID, "online")
 		case client := <-h.unregister:
-			if set, ok := h.clients[client.UserID]; ok {
-				if _, ok := set[client]; ok {
-					delete(set, client)
-					close(client.Send)
-					if len(set) == 0 {
-						delete(h.clients, client.UserID)
-						// Mark last_active and broadcast offline
-						h.DB.Exec(`UPDATE users SET last_active=NOW() WHERE id=$1`, client.UserID)
-						h.BroadcastPresence(client.UserID, "offline")
+			h.remove(client)
+		case ev := <-events:
+			for _, cid := range ev.InvalidConversations {
+				h.cache.dropConversation(cid)
+			}
+			for _, uid := range ev.InvalidUsers {
+				h.cache.dropUser(uid)
+			}
+			for _, ref := range ev.ClosedSessions {
+				for client := range h.clients[ref.UserID] {
+					if client.SessionID == ref.SessionID && client.revoke(CloseSessionRevoked, "session revoked") {
+						h.remove(client)
 					}
 				}
 			}
+			for _, d := range ev.Deliveries {
+				for client := range h.clients[d.UserID] {
+					if !client.deliver(d.Seq, d.Payload) {
+						// slow/broken client → evict
+						log.Printf("[hub] dropped slow client for user %d", d.UserID)
+						h.remove(client)
+					}
+				}
+			}
+		case <-prune.C:
+			go h.pruneEvents()
 		}
 	}
 }
 
-// BroadcastMessage sends a JSON payload to all participants of a conversation.
-func (h *Hub) BroadcastMessage(conversationID, senderID, messageID int64, content string) {
-	// Fetch all participants (single query)
-	rows, err := h.DB.Query(`SELECT user_id FROM participants WHERE conversation_id=$1 AND user_id!=$2`, conversationID, senderID)
-	if err != nil {
-		log.Printf("[hub] failed to fetch participants for conversation %d: %v", conversationID, err)
+// remove unregisters a client and closes its queue. It is a no-op for
+// clients that were already removed, so eviction and the read pump's own
+// unregister may both happen.
+func (h *Hub) remove(client *Client) {
+	set, ok := h.clients[client.UserID]
+	if !ok || !set[client] {
 		return
 	}
-	defer rows.Close()
-
-	// Fetch sender username
-	var senderUsername string
-	if err := h.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, senderID).Scan(&senderUsername); err != nil {
-		log.Printf("[hub] failed to fetch sender username for %d: %v", senderID, err)
-		senderUsername = "unknown"
+	delete(set, client)
+	client.close()
+	if len(set) == 0 {
+		delete(h.clients, client.UserID)
+		h.setPresence(client.UserID, false)
 	}
+}
 
-	// Fetch sent_at timestamp
-	var sentAt time.Time
-	if err := h.DB.QueryRow(`SELECT sent_at FROM messages WHERE id=$1`, messageID).Scan(&sentAt); err != nil {
-		log.Printf("[hub] failed to fetch sent_at for message %d: %v", messageID, err)
-		// Fallback to current time if DB query fails.
-		sentAt = time.Now()
+// CloseSession disconnects every connection of the session on all
+// instances, with close code CloseSessionRevoked.
+func (h *Hub) CloseSession(userID, sessionID int64) {
+	h.announce(Event{ClosedSessions: []SessionRef{{UserID: userID, SessionID: sessionID}}})
+}
+
+// setPresence records a local presence change for presenceLoop without
+// blocking. A change still pending for uid is replaced.
+func (h *Hub) setPresence(uid int64, online bool) {
+	h.presenceMu.Lock()
+	h.presence[uid] = online
+	h.presenceMu.Unlock()
+	select {
+	case h.presenceWake <- struct{}{}:
+	default:
 	}
+}
 
-	// Prepare wire message payload
-	wire := WireMessage{
-		Type:           "message",
-		ConversationID: conversationID,
-		MessageID:      messageID,
-		SenderID:       senderID,
-		SenderUsername: senderUsername,
-		Content:        content,
-		SentAt:         sentAt.Format(time.RFC3339), // FIX: Format the time.Time object to RFC3339
+// presenceLoop reports local presence changes to the broker and broadcasts
+// the ones that change the user's state across all nodes. Changes that
+// cancel out before it gets to them are reported as the latest one only.
+func (h *Hub) presenceLoop() {
+	for range h.presenceWake {
+		h.presenceMu.Lock()
+		changes := h.presence
+		h.presence = make(map[int64]bool)
+		h.presenceMu.Unlock()
+
+		for uid, online := range changes {
+			var changed bool
+			var err error
+			if online {
+				changed, err = h.Broker.Connected(uid)
+			} else {
+				changed, err = h.Broker.Disconnected(uid)
+			}
+			if err != nil {
+				log.Printf("[hub] failed to record presence for user %d: %v", uid, err)
+			}
+			// mark last_active on every transition
+			h.DB.Exec(`UPDATE users SET last_active=CURRENT_TIMESTAMP WHERE id=$1`, uid)
+			if !changed {
+				continue
+			}
+			status := "offline"
+			if online {
+				status = "online"
+			}
+			h.BroadcastPresence(uid, status)
+		}
 	}
-	payload, err := json.Marshal(wire)
+}
+
+// recipients runs a query returning user ids.
+func (h *Hub) recipients(query string, args ...any) ([]int64, error) {
+	rows, err := h.DB.Query(query, args...)
 	if err != nil {
-		log.Printf("[hub] failed to marshal wire message: %v", err)
-		return
+		return nil, err
 	}
-
-	// Iterate participants & broadcast
+	defer rows.Close()
+	var uids []int64
 	for rows.Next() {
 		var uid int64
 		if err := rows.Scan(&uid); err != nil {
 			log.Printf("[hub] failed to scan participant user_id: %v", err)
 			continue
 		}
-		// Add this line to log the recipient's ID
-		log.Printf("[hub] Attempting to send message %d to recipient %d", messageID, uid)
-		// Mark delivered for everyone except sender
-		if uid != senderID {
-			if _, err := h.DB.Exec(
-				`INSERT INTO message_status (message_id, user_id, status)
-				 VALUES ($1, $2, 'delivered') ON CONFLICT (message_id, user_id) DO NOTHING`, messageID, uid); err != nil {
-				log.Printf("[hub] failed to insert message_status for user %d: %v", uid, err)
-			}
+		uids = append(uids, uid)
+	}
+	return uids, rows.Err()
+}
+
+// publish appends wire to each recipient's event log, stamping it with that
+// user's next sequence number, and hands it to the broker for delivery.
+func (h *Hub) publish(uids []int64, wire WireMessage) {
+	h.publishMuted(uids, wire, nil)
+}
+
+// publishMuted is publish with Muted set on the copies for users in muted,
+// so their clients can skip notifying.
+//
+// Seqs are allocated and logged in one transaction, which is committed only
+// after the hand-off to the broker. Its UPDATE keeps the recipients' users
+// rows locked until then, so a concurrent publish to any of them, on any
+// node, hands off after this one and each user's events reach the broker in
+// seq order.
+func (h *Hub) publishMuted(uids []int64, wire WireMessage, muted map[int64]bool) {
+	if len(uids) == 0 {
+		return
+	}
+	tx, batch, err := h.logEvents(uids, wire, muted)
+	if err != nil {
+		log.Printf("[hub] failed to log %s event for %d users: %v", wire.Type, len(uids), err)
+		// still deliver it live; without a seq it is not replayed
+		if batch, err = deliveries(uids, wire, muted, nil); err != nil {
+			log.Printf("[hub] failed to marshal %s event: %v", wire.Type, err)
+			return
+		}
+	}
+	h.logMu.Lock()
+	h.dispatch(batch)
+	h.logMu.Unlock()
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			log.Printf("[hub] failed to commit %s event log: %v", wire.Type, err)
 		}
+	}
+}
 
-		// Send over WebSocket if connected
-		if set, ok := h.clients[uid]; ok {
-			for client := range set {
-				select {
-				case client.Send <- payload:
-				default:
-					// slow/broken client → drop
-					close(client.Send)
-					delete(set, client)
-					log.Printf("[hub] dropped slow client for user %d", uid)
-				}
-			}
+// logEvents bumps every recipient's event_seq and appends their copies of
+// wire to the event log in an open transaction. On error nothing is kept.
+func (h *Hub) logEvents(uids []int64, wire WireMessage, muted map[int64]bool) (*sql.Tx, []Delivery, error) {
+	// lock rows in id order so overlapping publishes cannot deadlock
+	ids := slices.Sorted(slices.Values(uids))
+	ids = slices.Compact(ids)
+
+	tx, err := h.DB.Begin()
+	if err != nil {
+		return nil, nil, err
+	}
+	seqs, err := h.nextSeqs(tx, ids)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	batch, err := deliveries(uids, wire, muted, seqs)
+	if err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	if err := h.insertEvents(tx, batch); err != nil {
+		tx.Rollback()
+		return nil, nil, err
+	}
+	return tx, batch, nil
+}
+
+// deliveries marshals a copy of wire per recipient, stamped with its seq
+// from seqs (zero when absent).
+func deliveries(uids []int64, wire WireMessage, muted map[int64]bool, seqs map[int64]int64) ([]Delivery, error) {
+	batch := make([]Delivery, 0, len(uids))
+	for _, uid := range uids {
+		wire.Seq = seqs[uid]
+		wire.Muted = muted[uid]
+		payload, err := json.Marshal(wire)
+		if err != nil {
+			return nil, err
 		}
+		batch = append(batch, Delivery{uid, wire.Seq, payload})
+	}
+	return batch, nil
+}
+
+// nextSeqs allocates the next event seq of each user in one statement.
+func (h *Hub) nextSeqs(tx *sql.Tx, uids []int64) (map[int64]int64, error) {
+	var rows *sql.Rows
+	var err error
+	if h.postgres {
+		rows, err = tx.Query(`UPDATE users SET event_seq = event_seq + 1 WHERE id = ANY($1) RETURNING id, event_seq`, pq.Array(uids))
+	} else {
+		ph := make([]string, len(uids))
+		args := make([]any, len(uids))
+		for i, uid := range uids {
+			ph[i] = fmt.Sprintf("$%d", i+1)
+			args[i] = uid
+		}
+		rows, err = tx.Query(`UPDATE users SET event_seq = event_seq + 1 WHERE id IN (`+strings.Join(ph, ",")+`) RETURNING id, event_seq`, args...)
+	}
+	if err != nil {
+		return nil, err
 	}
-	if err := rows.Err(); err != nil {
-		log.Printf("[hub] row iteration error: %v", err)
+	defer rows.Close()
+	seqs := make(map[int64]int64, len(uids))
+	for rows.Next() {
+		var uid, seq int64
+		if err := rows.Scan(&uid, &seq); err != nil {
+			return nil, err
+		}
+		seqs[uid] = seq
 	}
+	return seqs, rows.Err()
+}
+
+// insertEvents appends the logged deliveries of batch in one statement.
+func (h *Hub) insertEvents(tx *sql.Tx, batch []Delivery) error {
+	var uids, seqs []int64
+	var payloads []string
+	for _, d := range batch {
+		if d.Seq == 0 {
+			continue
+		}
+		uids = append(uids, d.UserID)
+		seqs = append(seqs, d.Seq)
+		payloads = append(payloads, string(d.Payload))
+	}
+	if len(uids) == 0 {
+		return nil
+	}
+	var err error
+	if h.postgres {
+		_, err = tx.Exec(`
+			INSERT INTO user_events (user_id, seq, payload)
+			SELECT * FROM unnest($1::bigint[], $2::bigint[], $3::text[])`,
+			pq.Array(uids), pq.Array(seqs), pq.Array(payloads))
+	} else {
+		rows := make([]string, len(uids))
+		args := make([]any, 0, 3*len(uids))
+		for i := range uids {
+			rows[i] = fmt.Sprintf("($%d, $%d, $%d)", 3*i+1, 3*i+2, 3*i+3)
+			args = append(args, uids[i], seqs[i], payloads[i])
+		}
+		_, err = tx.Exec(`INSERT INTO user_events (user_id, seq, payload) VALUES `+strings.Join(rows, ", "), args...)
+	}
+	return err
+}
+
+// transient delivers wire to each recipient's connections without logging
+// it. Typing and presence are only meaningful live.
+func (h *Hub) transient(uids []int64, wire WireMessage) {
+	payload, err := json.Marshal(wire)
+	if err != nil {
+		log.Printf("[hub] failed to marshal %s event: %v", wire.Type, err)
+		return
+	}
+	batch := make([]Delivery, len(uids))
+	for i, uid := range uids {
+		batch[i] = Delivery{UserID: uid, Payload: payload}
+	}
+	h.dispatch(batch)
+}
+
+// dispatch publishes deliveries to every node's Run loop.
+func (h *Hub) dispatch(batch []Delivery) {
+	if len(batch) == 0 {
+		return
+	}
+	if err := h.Broker.Publish(Event{Deliveries: batch}); err != nil {
+		log.Printf("[hub] failed to publish %d deliveries: %v", len(batch), err)
+	}
+}
+
+// pruneEvents drops logged events older than EventRetention.
+func (h *Hub) pruneEvents() {
+	if h.EventRetention <= 0 {
+		return
+	}
+	res, err := h.DB.Exec(`DELETE FROM user_events WHERE created_at < $1`, time.Now().Add(-h.EventRetention))
+	if err != nil {
+		log.Printf("[hub] failed to prune event log: %v", err)
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		log.Printf("[hub] pruned %d logged events", n)
+	}
+}
+
+// BroadcastMessage sends a new chat message to all participants of its
+// conversation, including the sender's other connections. The caller fills in
+// the message fields (conversation, sender, id, content, reply, attachments,
+// client id); type, sender username and a missing sent_at are resolved here.
+func (h *Hub) BroadcastMessage(wire WireMessage) {
+	conversationID, senderID, messageID := wire.ConversationID, wire.SenderID, wire.MessageID
+
+	// Fetch all participants (single query)
+	uids, err := h.conversationMembers(conversationID)
+	if err != nil {
+		log.Printf("[hub] failed to fetch participants for conversation %d: %v", conversationID, err)
+		return
+	}
+
+	// Fetch sender username
+	senderUsername := h.username(senderID)
+	if senderUsername == "" {
+		log.Printf("[hub] failed to fetch sender username for %d", senderID)
+		senderUsername = "unknown"
+	}
+
+	// Fetch sent_at timestamp
+	if wire.SentAt == "" {
+		var sentAt time.Time
+		if err := h.DB.QueryRow(`SELECT sent_at FROM messages WHERE id=$1`, messageID).Scan(&sentAt); err != nil {
+			log.Printf("[hub] failed to fetch sent_at for message %d: %v", messageID, err)
+			// Fallback to current time if DB query fails.
+			sentAt = time.Now()
+		}
+		wire.SentAt = sentAt.Format(time.RFC3339) // FIX: Format the time.Time object to RFC3339
+	}
+
+	// Prepare wire message payload
+	wire.Type = "message"
+	wire.SenderUsername = senderUsername
+
+	// Mark delivered for everyone except sender
+	for _, uid := range uids {
+		if uid == senderID {
+			continue
+		}
+		if _, err := h.DB.Exec(
+			`INSERT INTO message_status (message_id, user_id, status)
+			 VALUES ($1, $2, 'delivered') ON CONFLICT (message_id, user_id) DO NOTHING`, messageID, uid); err != nil {
+			log.Printf("[hub] failed to insert message_status for user %d: %v", uid, err)
+		}
+	}
+	h.publishMuted(uids, wire, h.mutedIn(conversationID))
 }
 
 // New helper: notify participants when someone reads a message
@@ -150,67 +463,33 @@ func (h *Hub) BroadcastReadReceipt(messageID, readerID int64) {
 		MessageID:      messageID,
 		SenderID:       readerID,
 	}
-	payload, err := json.Marshal(wire)
-	if err != nil {
-		log.Printf("BroadcastReadReceipt: failed to marshal JSON: %v", err)
-		return
-	}
 
-	rows, err := h.DB.Query(`SELECT user_id FROM participants WHERE conversation_id=$1 AND user_id<>$2`, convID, readerID)
+	uids, err := h.othersIn(convID, readerID)
 	if err != nil {
 		log.Printf("BroadcastReadReceipt: failed to query participants for convID %d: %v", convID, err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var uid int64
-		if err := rows.Scan(&uid); err != nil {
-			log.Printf("BroadcastReadReceipt: failed to scan participant uid: %v", err)
-			continue
-		}
-
-		if set, ok := h.clients[uid]; ok {
-			for cli := range set {
-				cli.Send <- payload // sent successful
-			}
-		}
-	}
-
-	if err := rows.Err(); err != nil {
-		log.Printf("BroadcastReadReceipt: rows iteration error: %v", err)
-	}
+	h.publish(uids, wire)
 }
 
 func (h *Hub) BroadcastTyping(convID, userID int64, eventType string) {
-	var username string
-	_ = h.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, userID).Scan(&username)
-
 	wire := WireMessage{
 		Type:           eventType, // "typing_start" or "typing_stop"
 		ConversationID: convID,
 		SenderID:       userID,
-		SenderUsername: username,
+		SenderUsername: h.username(userID),
 	}
-	payload, _ := json.Marshal(wire)
-
-	rows, _ := h.DB.Query(`SELECT user_id FROM participants WHERE conversation_id=$1 AND user_id<>$2`, convID, userID)
-	defer rows.Close()
 
-	for rows.Next() {
-		var uid int64
-		_ = rows.Scan(&uid)
-		if set, ok := h.clients[uid]; ok {
-			for cli := range set {
-				select {
-				case cli.Send <- payload:
-				default:
-					close(cli.Send)
-					delete(set, cli)
-				}
-			}
+	// typing is pure notification, so muted members don't get it at all
+	others, _ := h.othersIn(convID, userID)
+	muted := h.mutedIn(convID)
+	uids := make([]int64, 0, len(others))
+	for _, uid := range others {
+		if !muted[uid] {
+			uids = append(uids, uid)
 		}
 	}
+	h.transient(uids, wire)
 }
 
 // update: BroadcastPresence now includes last_active timestamp
@@ -227,32 +506,17 @@ func (h *Hub) BroadcastPresence(userID int64, status string) {
 		Content:        status,
 		LastActive:     lastActive.Format(time.RFC3339), // Use the new field
 	}
-	payload, _ := json.Marshal(wire)
 
 	//Find all conversations the user belongs to
-	rows, _ := h.DB.Query(`
+	uids, _ := h.recipients(`
         SELECT DISTINCT p2.user_id
         FROM participants p1
         JOIN participants p2 ON p1.conversation_id = p2.conversation_id
         WHERE p1.user_id = $1 AND p2.user_id <> $2`,
 		userID, userID,
 	)
-	defer rows.Close()
 	// Broadcast to all other participants
-	for rows.Next() {
-		var uid int64
-		_ = rows.Scan(&uid)
-		if set, ok := h.clients[uid]; ok {
-			for cli := range set {
-				select {
-				case cli.Send <- payload:
-				default:
-					close(cli.Send)
-					delete(set, cli)
-				}
-			}
-		}
-	}
+	h.transient(uids, wire)
 }
 
 func (h *Hub) BroadcastConversationUpdate(conversationID int64, updateType string) {
@@ -261,34 +525,24 @@ func (h *Hub) BroadcastConversationUpdate(conversationID int64, updateType strin
 		ConversationID: conversationID,
 		Content:        updateType, // e.g., "new_conversation", "participant_added", "participant_removed"
 	}
-	payload, _ := json.Marshal(wire)
 
 	// Fetch all participants of the conversation
-	rows, err := h.DB.Query(`SELECT user_id FROM participants WHERE conversation_id=$1`, conversationID)
+	uids, err := h.conversationMembers(conversationID)
 	if err != nil {
 		log.Printf("[hub] failed to fetch participants for broadcast update: %v", err)
 		return
 	}
-	defer rows.Close()
+	h.publish(uids, wire)
+}
 
-	for rows.Next() {
-		var uid int64
-		if err := rows.Scan(&uid); err != nil {
-			log.Printf("[hub] failed to scan participant user_id for broadcast update: %v", err)
-			continue
-		}
-		if set, ok := h.clients[uid]; ok {
-			for client := range set {
-				select {
-				case client.Send <- payload:
-				default:
-					close(client.Send)
-					delete(set, client)
-					log.Printf("[hub] dropped slow client for user %d during broadcast update", uid)
-				}
-			}
-		}
-	}
+// NotifyConversationUpdate sends a conversation_update to a single user, for
+// changes that concern someone who is no longer a participant.
+func (h *Hub) NotifyConversationUpdate(userID, conversationID int64, updateType string) {
+	h.publish([]int64{userID}, WireMessage{
+		Type:           "conversation_update",
+		ConversationID: conversationID,
+		Content:        updateType,
+	})
 }
 
 // BroadcastSystemMessage sends a system-generated message to a conversation's participants.
@@ -304,76 +558,60 @@ func (h *Hub) BroadcastSystemMessage(conversationID int64, content string) {
 		Content:        content,
 		SentAt:         time.Now().UTC().Format(time.RFC3339),
 	}
-	payload, err := json.Marshal(wire)
-	if err != nil {
-		log.Printf("[hub] failed to marshal system message: %v", err)
-		return
-	}
 
 	// Fetch all participants (including the one who initiated the removal)
-	rows, err := h.DB.Query(`SELECT user_id FROM participants WHERE conversation_id=$1`, conversationID)
+	uids, err := h.conversationMembers(conversationID)
 	if err != nil {
 		log.Printf("[hub] failed to fetch participants for conversation %d: %v", conversationID, err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var uid int64
-		if err := rows.Scan(&uid); err != nil {
-			log.Printf("[hub] failed to scan participant user_id: %v", err)
-			continue
-		}
-
-		if set, ok := h.clients[uid]; ok {
-			for client := range set {
-				select {
-				case client.Send <- payload:
-				default:
-					close(client.Send)
-					delete(set, client)
-					log.Printf("[hub] dropped slow client for user %d", uid)
-				}
-			}
-		}
-	}
+	h.publishMuted(uids, wire, h.mutedIn(conversationID))
 }
 
-func (h *Hub) BroadcastToConversation(conversationID int64, payload []byte) {
-	rows, err := h.DB.Query(`SELECT user_id FROM participants WHERE conversation_id=$1`, conversationID)
+// BroadcastToConversation logs and delivers wire to every participant of
+// its conversation.
+func (h *Hub) BroadcastToConversation(wire WireMessage) {
+	uids, err := h.conversationMembers(wire.ConversationID)
 	if err != nil {
-		log.Printf("[hub] failed to fetch participants for conversation %d: %v", conversationID, err)
+		log.Printf("[hub] failed to fetch participants for conversation %d: %v", wire.ConversationID, err)
 		return
 	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var uid int64
-		if err := rows.Scan(&uid); err != nil {
-			log.Printf("[hub] failed to scan participant user_id: %v", err)
-			continue
-		}
-		if set, ok := h.clients[uid]; ok {
-			for client := range set {
-				select {
-				case client.Send <- payload:
-				default:
-					close(client.Send)
-					delete(set, client)
-					log.Printf("[hub] dropped slow client for user %d", uid)
-				}
-			}
-		}
-	}
+	h.publish(uids, wire)
 }
 
-func (h *Hub) BroadcastEditedMessage(conversationID, messageID int64, newContent string) {
-	wire := WireMessage{
+func (h *Hub) BroadcastEditedMessage(conversationID, messageID int64, newContent string, editedAt time.Time) {
+	h.BroadcastToConversation(WireMessage{
 		Type:           "edited_message",
 		ConversationID: conversationID,
 		MessageID:      messageID,
 		Content:        newContent,
+		EditedAt:       editedAt.UTC().Format(time.RFC3339),
+	})
+}
+
+func (h *Hub) BroadcastDeletedMessage(conversationID, messageID int64) {
+	h.BroadcastToConversation(WireMessage{
+		Type:           "deleted_message",
+		ConversationID: conversationID,
+		MessageID:      messageID,
+	})
+}
+
+// BroadcastReaction notifies participants that userID added or removed an
+// emoji reaction on a message. action is "added" or "removed".
+func (h *Hub) BroadcastReaction(conversationID, messageID, userID int64, emoji, action string) {
+	uids, err := h.conversationMembers(conversationID)
+	if err != nil {
+		log.Printf("[hub] failed to fetch participants for conversation %d: %v", conversationID, err)
+		return
 	}
-	payload, _ := json.Marshal(&wire)
-	h.BroadcastToConversation(conversationID, payload)
+	h.publishMuted(uids, WireMessage{
+		Type:           "reaction",
+		ConversationID: conversationID,
+		MessageID:      messageID,
+		SenderID:       userID,
+		SenderUsername: h.username(userID),
+		Content:        action,
+		Emoji:          emoji,
+	}, h.mutedIn(conversationID))
 }
@@ -0,0 +1,283 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// newTestHub starts a hub on a throwaway SQLite database holding the tables
+// the hub reads: users 1..users all share conversation 1.
+func newTestHub(t *testing.T, users int) *Hub {
+	t.Helper()
+	dsn := filepath.Join(t.TempDir(), "hub.db") + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	stmts := []string{
+		`CREATE TABLE users (id INTEGER PRIMARY KEY, username TEXT NOT NULL, last_active TIMESTAMP, event_seq BIGINT NOT NULL DEFAULT 0)`,
+		`CREATE TABLE participants (conversation_id BIGINT NOT NULL, user_id BIGINT NOT NULL, muted_until TIMESTAMP, PRIMARY KEY (conversation_id, user_id))`,
+		`CREATE TABLE messages (id INTEGER PRIMARY KEY, conversation_id BIGINT NOT NULL, sent_at TIMESTAMP)`,
+		`CREATE TABLE message_status (message_id BIGINT NOT NULL, user_id BIGINT NOT NULL, status TEXT NOT NULL, PRIMARY KEY (message_id, user_id))`,
+		`CREATE TABLE user_events (user_id BIGINT NOT NULL, seq BIGINT NOT NULL, payload TEXT NOT NULL, created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP, PRIMARY KEY (user_id, seq))`,
+		`INSERT INTO messages (id, conversation_id, sent_at) VALUES (1, 1, CURRENT_TIMESTAMP)`,
+	}
+	for uid := 1; uid <= users; uid++ {
+		stmts = append(stmts,
+			fmt.Sprintf(`INSERT INTO users (id, username) VALUES (%d, 'user%d')`, uid, uid),
+			fmt.Sprintf(`INSERT INTO participants (conversation_id, user_id) VALUES (1, %d)`, uid))
+	}
+	for _, st := range stmts {
+		if _, err := db.Exec(st); err != nil {
+			t.Fatalf("%s: %v", st, err)
+		}
+	}
+
+	h := NewHub(db)
+	go h.Run()
+	return h
+}
+
+// drain reads a client's queue until the hub closes it and returns the
+// sequence numbers seen, in order.
+func drain(c *Client) <-chan []int64 {
+	out := make(chan []int64, 1)
+	go func() {
+		var seqs []int64
+		for payload := range c.Send {
+			var w WireMessage
+			if err := json.Unmarshal(payload, &w); err == nil && w.Seq != 0 {
+				seqs = append(seqs, w.Seq)
+			}
+		}
+		out <- seqs
+	}()
+	return out
+}
+
+// settle waits until Run has taken every published event off the memory
+// broker. Registry changes sent afterwards cannot overtake those events.
+func settle(t *testing.T, h *Hub) {
+	t.Helper()
+	b := h.Broker.(*MemoryBroker)
+	deadline := time.Now().Add(5 * time.Second)
+	for len(b.events) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("hub did not drain broker events")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// TestHubConcurrentRegistry hammers register, unregister, eviction and every
+// broadcast path at once. Run with -race.
+func TestHubConcurrentRegistry(t *testing.T) {
+	const (
+		users       = 4
+		churners    = 8
+		connects    = 25
+		broadcasts  = 40
+		broadcaster = 4
+	)
+	h := newTestHub(t, users)
+
+	// a steady connection that must see every logged event exactly once, in order
+	steady := &Client{Hub: h, Send: make(chan []byte, 4096), UserID: 1}
+	h.register <- steady
+	steadySeqs := drain(steady)
+
+	// a connection that never reads and must be evicted, not panic
+	stuck := &Client{Hub: h, Send: make(chan []byte, 1), UserID: 2}
+	h.register <- stuck
+
+	var wg sync.WaitGroup
+	for i := 0; i < churners; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < connects; j++ {
+				c := &Client{Hub: h, Send: make(chan []byte, 8), UserID: int64(1 + (i+j)%users)}
+				h.register <- c
+				done := drain(c)
+				c.ack(Ack{For: "send_message", OK: true})
+				h.unregister <- c
+				h.unregister <- c // a second unregister must be harmless
+				<-done
+			}
+		}(i)
+	}
+	for i := 0; i < broadcaster; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < broadcasts; j++ {
+				switch j % 4 {
+				case 0:
+					h.BroadcastMessage(WireMessage{ConversationID: 1, MessageID: 1, SenderID: int64(1 + i%users), Content: "hi"})
+				case 1:
+					h.BroadcastTyping(1, int64(1+i%users), "typing_start")
+				case 2:
+					h.BroadcastConversationUpdate(1, "participant_added")
+				case 3:
+					h.BroadcastPresence(int64(1+i%users), "online")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	settle(t, h)
+
+	h.unregister <- steady
+	h.unregister <- stuck
+	seqs := <-steadySeqs
+
+	// messages and conversation updates are logged; typing and presence are not
+	want := broadcaster * broadcasts / 2
+	if len(seqs) != want {
+		t.Fatalf("steady client got %d logged events, want %d", len(seqs), want)
+	}
+	for i, seq := range seqs {
+		if seq != int64(i+1) {
+			t.Fatalf("event %d has seq %d, want %d", i, seq, i+1)
+		}
+	}
+
+	select {
+	case _, ok := <-stuck.Send:
+		for ok {
+			_, ok = <-stuck.Send
+		}
+	case <-time.After(time.Second):
+		t.Fatal("stuck client was not closed")
+	}
+}
+
+// TestHubCloseSession closes only the connections of the revoked session.
+func TestHubCloseSession(t *testing.T) {
+	h := newTestHub(t, 2)
+
+	revoked := &Client{Hub: h, Send: make(chan []byte, 16), UserID: 1, SessionID: 10}
+	other := &Client{Hub: h, Send: make(chan []byte, 16), UserID: 1, SessionID: 11}
+	h.register <- revoked
+	h.register <- other
+
+	h.CloseSession(1, 10)
+	select {
+	case _, ok := <-revoked.Send:
+		for ok {
+			_, ok = <-revoked.Send
+		}
+	case <-time.After(time.Second):
+		t.Fatal("revoked session was not closed")
+	}
+	if code := revoked.closeCode; code != CloseSessionRevoked {
+		t.Fatalf("close code %d, want %d", code, CloseSessionRevoked)
+	}
+
+	h.BroadcastConversationUpdate(1, "participant_added")
+	select {
+	case <-other.Send:
+	case <-time.After(time.Second):
+		t.Fatal("other session stopped receiving events")
+	}
+	h.unregister <- other
+}
+
+// TestHubSeqAfterFailedInsert checks that an event whose log insert fails is
+// still delivered live but leaves no gap in the recipients' seqs.
+func TestHubSeqAfterFailedInsert(t *testing.T) {
+	h := newTestHub(t, 2)
+	if _, err := h.DB.Exec(`
+		CREATE TRIGGER fail_log BEFORE INSERT ON user_events
+		WHEN NEW.payload LIKE '%"content":"fail"%'
+		BEGIN SELECT RAISE(ABORT, 'insert failed'); END`); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Client{Hub: h, Send: make(chan []byte, 16), UserID: 1}
+	h.register <- c
+	for _, content := range []string{"one", "fail", "two"} {
+		h.BroadcastMessage(WireMessage{ConversationID: 1, MessageID: 1, SenderID: 2, Content: content})
+	}
+
+	var got []WireMessage
+	for len(got) < 3 {
+		select {
+		case payload := <-c.Send:
+			var w WireMessage
+			if err := json.Unmarshal(payload, &w); err != nil {
+				t.Fatal(err)
+			}
+			if w.Type == "message" {
+				got = append(got, w)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("got %d messages, want 3", len(got))
+		}
+	}
+	h.unregister <- c
+
+	for i, want := range []struct {
+		content string
+		seq     int64
+	}{{"one", 1}, {"fail", 0}, {"two", 2}} {
+		if got[i].Content != want.content || got[i].Seq != want.seq {
+			t.Fatalf("message %d is %q with seq %d, want %q with seq %d", i, got[i].Content, got[i].Seq, want.content, want.seq)
+		}
+	}
+	for uid := 1; uid <= 2; uid++ {
+		var seq, logged int64
+		if err := h.DB.QueryRow(`SELECT event_seq FROM users WHERE id=$1`, uid).Scan(&seq); err != nil {
+			t.Fatal(err)
+		}
+		if err := h.DB.QueryRow(`SELECT COUNT(1) FROM user_events WHERE user_id=$1 AND seq <= $2`, uid, seq).Scan(&logged); err != nil {
+			t.Fatal(err)
+		}
+		if seq != 2 || logged != 2 {
+			t.Fatalf("user %d: event_seq %d with %d logged events, want 2 and 2", uid, seq, logged)
+		}
+	}
+}
+
+// TestCatchUpKeepsOlderLiveEvents replays the log while a live event older
+// than the newest logged one is held; it must be written, and the held copy
+// of a replayed event must not.
+func TestCatchUpKeepsOlderLiveEvents(t *testing.T) {
+	h := newTestHub(t, 1)
+	for _, st := range []string{
+		`UPDATE users SET event_seq = 4 WHERE id = 1`,
+		`INSERT INTO user_events (user_id, seq, payload) VALUES (1, 1, '{"seq":1}'), (1, 2, '{"seq":2}'), (1, 4, '{"seq":4}')`,
+	} {
+		if _, err := h.DB.Exec(st); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := &Client{Hub: h, Send: make(chan []byte, 16), UserID: 1, catchingUp: true}
+	c.deliver(4, []byte(`{"seq":4}`))
+	c.deliver(3, []byte(`{"seq":3}`))
+	if !c.catchUp(0) {
+		t.Fatal("catch-up failed")
+	}
+	close(c.Send)
+	var seqs []int64
+	for payload := range c.Send {
+		var w WireMessage
+		if err := json.Unmarshal(payload, &w); err != nil {
+			t.Fatal(err)
+		}
+		seqs = append(seqs, w.Seq)
+	}
+	if fmt.Sprint(seqs) != "[1 2 4 3]" {
+		t.Fatalf("got seqs %v, want [1 2 4 3]", seqs)
+	}
+}
@@ -0,0 +1,141 @@
+package chat
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+// InboundFrame is a client-to-server WebSocket event. Ref is an opaque value
+// chosen by the client and echoed in the matching ack.
+type InboundFrame struct {
+	Type           string  `json:"type"` // "typing_start", "typing_stop", "send_message", "mark_read", "edit_message"
+	Ref            string  `json:"ref,omitempty"`
+	ConversationID int64   `json:"conversation_id,omitempty"`
+	MessageID      int64   `json:"message_id,omitempty"`  // edit_message
+	MessageIDs     []int64 `json:"message_ids,omitempty"` // mark_read
+	Content        string  `json:"content,omitempty"`
+
+	ReplyToMessageID *int64  `json:"reply_to_message_id,omitempty"`
+	AttachmentIDs    []int64 `json:"attachment_ids,omitempty"`
+	ClientMessageID  string  `json:"client_message_id,omitempty"`
+}
+
+// Ack answers a send_message, mark_read or edit_message frame. Error is a
+// stable code and Message a human readable description; both are empty on
+// success.
+type Ack struct {
+	Type            string `json:"type"` // always "ack"
+	Ref             string `json:"ref,omitempty"`
+	For             string `json:"for"`
+	OK              bool   `json:"ok"`
+	MessageID       int64  `json:"message_id,omitempty"`
+	ClientMessageID string `json:"client_message_id,omitempty"`
+	Duplicate       bool   `json:"duplicate,omitempty"`
+	Error           string `json:"error,omitempty"`
+	Message         string `json:"message,omitempty"`
+	// RetryAfter is the number of seconds to wait after a slow_mode error.
+	RetryAfter int `json:"retry_after,omitempty"`
+}
+
+type SendRequest struct {
+	ConversationID   int64
+	Content          string
+	ReplyToMessageID *int64
+	AttachmentIDs    []int64
+	ClientMessageID  string
+}
+
+type SendResult struct {
+	MessageID int64
+	Duplicate bool
+}
+
+// MessageService performs message operations on behalf of a connected user.
+// It is implemented by messages.Service so that frames get exactly the same
+// validation and persistence as the REST endpoints.
+type MessageService interface {
+	SendMessage(userID int64, req SendRequest) (SendResult, error)
+	MarkRead(userID int64, messageIDs []int64) error
+	EditMessage(userID, messageID int64, content string) error
+}
+
+// handleFrame dispatches one inbound frame. Typing events are fire-and-forget;
+// every other type is answered with an ack.
+func (c *Client) handleFrame(raw []byte) {
+	var f InboundFrame
+	if err := json.Unmarshal(raw, &f); err != nil {
+		c.ack(Ack{Error: "bad_frame", Message: "frame is not valid JSON"})
+		return
+	}
+
+	switch f.Type {
+	case "typing_start", "typing_stop":
+		c.Hub.BroadcastTyping(f.ConversationID, c.UserID, f.Type)
+		return
+	}
+
+	ack := Ack{Ref: f.Ref, For: f.Type}
+	if c.Hub.Messages == nil && (f.Type == "send_message" || f.Type == "mark_read" || f.Type == "edit_message") {
+		ack.Error, ack.Message = "unavailable", "messaging over websocket is not enabled"
+		c.ack(ack)
+		return
+	}
+
+	var err error
+	switch f.Type {
+	case "send_message":
+		var res SendResult
+		res, err = c.Hub.Messages.SendMessage(c.UserID, SendRequest{
+			ConversationID:   f.ConversationID,
+			Content:          f.Content,
+			ReplyToMessageID: f.ReplyToMessageID,
+			AttachmentIDs:    f.AttachmentIDs,
+			ClientMessageID:  f.ClientMessageID,
+		})
+		ack.MessageID, ack.ClientMessageID, ack.Duplicate = res.MessageID, f.ClientMessageID, res.Duplicate
+	case "mark_read":
+		err = c.Hub.Messages.MarkRead(c.UserID, f.MessageIDs)
+	case "edit_message":
+		err = c.Hub.Messages.EditMessage(c.UserID, f.MessageID, f.Content)
+		ack.MessageID = f.MessageID
+	default:
+		ack.Error, ack.Message = "unknown_type", "unsupported frame type"
+		c.ack(ack)
+		return
+	}
+
+	if err != nil {
+		ack.Error, ack.Message = errorCode(err), err.Error()
+		var limited interface{ RetryAfterSeconds() int }
+		if errors.As(err, &limited) {
+			ack.RetryAfter = limited.RetryAfterSeconds()
+		}
+	} else {
+		ack.OK = true
+	}
+	c.ack(ack)
+}
+
+// errorCode extracts a stable code from err, falling back to "internal".
+func errorCode(err error) string {
+	var coded interface{ ErrorCode() string }
+	if errors.As(err, &coded) {
+		return coded.ErrorCode()
+	}
+	return "internal"
+}
+
+// ack queues a reply for this connection only. A client that is not draining
+// its queue loses the ack rather than stalling the read loop.
+func (c *Client) ack(a Ack) {
+	a.Type = "ack"
+	b, err := json.Marshal(a)
+	if err != nil {
+		log.Printf("[hub] failed to marshal ack: %v", err)
+		return
+	}
+	if !c.deliver(0, b) {
+		log.Printf("[hub] dropping ack for user %d: send buffer full", c.UserID)
+	}
+}
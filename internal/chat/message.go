@@ -1,7 +1,8 @@
 package chat
 
 type WireMessage struct {
-	Type           string `json:"type"` // "message", "read_receipt", "typing_start", "typing_stop", "presence","edited_message","deleted_message"
+	Type           string `json:"type"`          // "message", "read_receipt", "typing_start", "typing_stop", "presence","edited_message","deleted_message","reaction","resync"
+	Seq            int64  `json:"seq,omitempty"` // per-recipient position in the event log; unset for typing/presence
 	ConversationID int64  `json:"conversation_id,omitempty"`
 	MessageID      int64  `json:"message_id,omitempty"`
 	SenderID       int64  `json:"sender_id"`
@@ -9,4 +10,27 @@ type WireMessage struct {
 	Content        string `json:"content,omitempty"` // used for presence = "online"/"offline"
 	SentAt         string `json:"sent_at,omitempty"`
 	LastActive     string `json:"last_active,omitempty"` // used for presence
+	Emoji          string `json:"emoji,omitempty"`       // used for reaction, content = "added"/"removed"
+	EditedAt       string `json:"edited_at,omitempty"`   // used for edited_message
+
+	ReplyToMessageID int64        `json:"reply_to_message_id,omitempty"`
+	Attachments      []Attachment `json:"attachments,omitempty"`
+	ClientMessageID  string       `json:"client_message_id,omitempty"` // echoed so the sender's tabs can reconcile
+
+	// Muted is set on message, system_message and reaction events for
+	// recipients who muted the conversation; clients should not notify.
+	Muted bool `json:"muted,omitempty"`
+}
+
+// Attachment describes a file linked to a message. URLs are relative to the
+// API host and require the same authentication as other endpoints.
+type Attachment struct {
+	ID           int64  `json:"id"`
+	FileName     string `json:"file_name"`
+	MimeType     string `json:"mime_type"`
+	Size         int64  `json:"size"`
+	Width        int    `json:"width,omitempty"`
+	Height       int    `json:"height,omitempty"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
 }
@@ -0,0 +1,131 @@
+package chat
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// maxBacklog bounds how many live events are held for a connection that is
+// still replaying; beyond it the client is told to resync instead.
+const maxBacklog = 1024
+
+// catchUp writes every logged event after since to the connection, then
+// flushes the live events that arrived meanwhile and switches the client to
+// live delivery. The flush skips exactly the seqs already replayed rather
+// than everything below the highest one, so a held event that is older than
+// a replayed one is not dropped. If the log no longer reaches back to since, a single
+// "resync" event carrying the current seq is sent instead and the client is
+// expected to refetch its state over REST. It reports false when the
+// connection stopped accepting writes.
+func (c *Client) catchUp(since int64) bool {
+	db := c.Hub.DB
+	var current int64
+	var oldest sql.NullInt64
+	err := db.QueryRow(`SELECT event_seq FROM users WHERE id=$1`, c.UserID).Scan(&current)
+	if err == nil {
+		err = db.QueryRow(`SELECT MIN(seq) FROM user_events WHERE user_id=$1`, c.UserID).Scan(&oldest)
+	}
+	first := current + 1
+	if oldest.Valid {
+		first = oldest.Int64
+	}
+
+	floor, replayed := since, make(map[int64]bool)
+	if err != nil || since > current || since+1 < first {
+		if err != nil {
+			log.Printf("[hub] failed to read event log position for user %d: %v", c.UserID, err)
+		}
+		if !c.resync(current) {
+			return false
+		}
+		floor = current
+	} else {
+		rows, err := db.Query(`SELECT seq, payload FROM user_events WHERE user_id=$1 AND seq > $2 ORDER BY seq`, c.UserID, since)
+		if err != nil {
+			log.Printf("[hub] failed to replay events for user %d: %v", c.UserID, err)
+			return c.finishCatchUp(floor, replayed, true)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var seq int64
+			var payload string
+			if err := rows.Scan(&seq, &payload); err != nil {
+				log.Printf("[hub] failed to scan logged event for user %d: %v", c.UserID, err)
+				continue
+			}
+			if !c.push([]byte(payload)) {
+				return false
+			}
+			replayed[seq] = true
+		}
+	}
+	return c.finishCatchUp(floor, replayed, false)
+}
+
+// finishCatchUp writes the held live events above floor that are not in
+// sent and turns on live delivery. A resync is sent instead when events may have been lost.
+// Writes happen outside mu so that the hub is never blocked on this client;
+// the hub does not close Send while the client is catching up.
+func (c *Client) finishCatchUp(floor int64, sent map[int64]bool, lost bool) bool {
+	for {
+		c.mu.Lock()
+		backlog, overflow := c.backlog, c.overflow
+		c.backlog, c.overflow = nil, false
+		if c.closeCode != 0 {
+			// revoked while catching up; the hub left Send open for us
+			c.mu.Unlock()
+			c.Conn.WriteControl(websocket.CloseMessage, c.closeMessage(), time.Now().Add(writeWait))
+			return false
+		}
+		if len(backlog) == 0 && !overflow && !lost {
+			c.catchingUp = false
+			c.mu.Unlock()
+			return true
+		}
+		c.mu.Unlock()
+
+		if lost || overflow {
+			lost = false
+			var current int64
+			if err := c.Hub.DB.QueryRow(`SELECT event_seq FROM users WHERE id=$1`, c.UserID).Scan(&current); err != nil {
+				log.Printf("[hub] failed to read event seq for user %d: %v", c.UserID, err)
+			}
+			if !c.resync(current) {
+				return false
+			}
+			floor = current
+			continue
+		}
+		for _, q := range backlog {
+			// seq 0 is a transient event (typing, presence)
+			if q.seq != 0 && (q.seq <= floor || sent[q.seq]) {
+				continue
+			}
+			if !c.push(q.payload) {
+				return false
+			}
+			sent[q.seq] = true
+		}
+	}
+}
+
+func (c *Client) resync(seq int64) bool {
+	payload, _ := json.Marshal(WireMessage{Type: "resync", Seq: seq})
+	return c.push(payload)
+}
+
+// push writes to the connection's queue, giving the write pump up to
+// writeWait to make room.
+func (c *Client) push(payload []byte) bool {
+	select {
+	case c.Send <- payload:
+		return true
+	case <-time.After(writeWait):
+		log.Printf("[hub] timed out replaying events for user %d", c.UserID)
+		return false
+	}
+}
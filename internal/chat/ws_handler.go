@@ -3,6 +3,7 @@ package chat
 import (
 	"log"
 	"net/http"
+	"strconv"
 
 	"github.com/ageniuscoder/mmchat/backend/internal/auth"
 	"github.com/gin-gonic/gin"
@@ -12,18 +13,31 @@ import (
 var upgrader = websocket.Upgrader{
 	ReadBufferSize:  1024,
 	WriteBufferSize: 1024,
-	// Use CheckOrigin to allow connections from your frontend URL
+	// Use CheckOrigin to allow connections from your frontend URL. Native
+	// clients send no Origin; browsers always do.
 	CheckOrigin: func(r *http.Request) bool {
 		origin := r.Header.Get("Origin")
-		return origin == "http://localhost:5173" || origin == "https://chatfrontend-mijn.onrender.com"
+		return origin == "" || origin == "http://localhost:5173" || origin == "https://chatfrontend-mijn.onrender.com"
 	},
 }
 
 // RegisterWS mounts GET /ws for authenticated clients.
 // The Gin context is automatically checked by JWTMiddleware
-func RegisterWS(rg *gin.RouterGroup, hub *Hub, jwtSecret string) {
+func RegisterWS(rg *gin.RouterGroup, hub *Hub) {
 	rg.GET("/ws", func(c *gin.Context) {
 		uid := auth.MustUserID(c)
+		sid, _ := auth.SessionIDFromContext(c)
+
+		// since=<seq> asks for the events missed after seq to be replayed
+		var since int64 = -1
+		if raw := c.Query("since"); raw != "" {
+			n, err := strconv.ParseInt(raw, 10, 64)
+			if err != nil || n < 0 {
+				c.JSON(http.StatusBadRequest, gin.H{"error": "since must be a non-negative sequence number"})
+				return
+			}
+			since = n
+		}
 
 		conn, err := upgrader.Upgrade(c.Writer, c.Request, nil)
 		if err != nil {
@@ -33,14 +47,24 @@ func RegisterWS(rg *gin.RouterGroup, hub *Hub, jwtSecret string) {
 		}
 
 		client := &Client{
-			Hub:    hub,
-			Conn:   conn,
-			Send:   make(chan []byte, 256),
-			UserID: uid,
+			Hub:       hub,
+			Conn:      conn,
+			Send:      make(chan []byte, 256),
+			UserID:    uid,
+			SessionID: sid,
+
+			catchingUp: since >= 0,
+			ready:      make(chan struct{}),
 		}
 		hub.register <- client
 
 		go client.writePump()
+		if since >= 0 {
+			<-client.ready
+			if !client.catchUp(since) {
+				conn.Close()
+			}
+		}
 		go client.readPump()
 	})
 }
@@ -3,17 +3,55 @@ package config
 import (
 	"os"
 	"strconv"
+	"strings"
 )
 
 type Config struct {
-	Addr           string
-	JWTSecret      string
+	Addr      string
+	JWTSecret string
+	// JWTTTLMin is the lifetime of an access token; clients renew it with
+	// their refresh token, which lasts RefreshTTLDays.
 	JWTTTLMin      int
-	PostgresDSN    string
-	OTPDigits      int
-	OTPTTLSec      int
-	SendGridAPIKey string
-	SendGridFrom   string
+	RefreshTTLDays int
+	// AuthTokenSources is the comma separated precedence of places an
+	// access token is read from: header, cookie, query.
+	AuthTokenSources string
+	PostgresDSN      string
+	OTPDigits        int
+	OTPTTLSec        int
+	SendGridAPIKey   string
+	SendGridFrom     string
+	// OTPMaxAttempts is how many wrong guesses burn an emailed code.
+	OTPMaxAttempts int
+	// Failed logins and code checks back off exponentially from
+	// LockoutBaseSec up to LockoutMaxSec once an account (or email and
+	// purpose) exceeds LoginMaxFailures, or an IP exceeds IPMaxFailures.
+	LoginMaxFailures int
+	IPMaxFailures    int
+	LockoutBaseSec   int
+	LockoutMaxSec    int
+	// DeleteWindowMin bounds how long after sending a message its sender may
+	// still delete it for everyone. Zero disables the limit.
+	DeleteWindowMin int
+	// AttachmentsDir is where the local blob store keeps uploaded files.
+	AttachmentsDir  string
+	AttachmentMaxMB int
+	// Uploads not sent with a message within AttachmentUnclaimedTTLMin are
+	// deleted; a user may hold at most AttachmentMaxUnclaimed of them.
+	AttachmentUnclaimedTTLMin int
+	AttachmentMaxUnclaimed    int
+	// EventRetentionHours is how long WebSocket events stay in the per-user
+	// log for reconnect catch-up. Zero keeps them forever.
+	EventRetentionHours int
+	// Broker selects how WebSocket events reach other instances: "memory"
+	// for a single instance or "postgres" for LISTEN/NOTIFY fan-out.
+	Broker string
+	// TrustedProxies lists the proxy addresses or CIDRs whose
+	// X-Forwarded-For is believed for client IPs; empty trusts none.
+	TrustedProxies []string
+	// DebugAddr, when set, serves expvar metrics at /debug/vars on a
+	// separate listener.
+	DebugAddr string
 }
 
 func getenv(key, def string) string {
@@ -24,20 +62,62 @@ func getenv(key, def string) string {
 	return def
 }
 
+// splitList splits a comma separated value, dropping empty entries.
+func splitList(val string) []string {
+	var out []string
+	for _, part := range strings.Split(val, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
 func MustLoad() Config {
-	jwtttl, _ := strconv.Atoi(getenv("JWT_TTL_MIN", "1440"))
+	jwtttl, _ := strconv.Atoi(getenv("JWT_TTL_MIN", "15"))
+	refreshttl, _ := strconv.Atoi(getenv("REFRESH_TTL_DAYS", "30"))
 	otpdigit, _ := strconv.Atoi(getenv("OTP_DIGITS", "6"))
 	otpttl, _ := strconv.Atoi(getenv("OTP_TTL_SEC", "300"))
+	otpattempts, _ := strconv.Atoi(getenv("OTP_MAX_ATTEMPTS", "5"))
+	loginfailures, _ := strconv.Atoi(getenv("LOGIN_MAX_FAILURES", "5"))
+	ipfailures, _ := strconv.Atoi(getenv("IP_MAX_FAILURES", "50"))
+	lockoutbase, _ := strconv.Atoi(getenv("LOCKOUT_BASE_SEC", "30"))
+	lockoutmax, _ := strconv.Atoi(getenv("LOCKOUT_MAX_SEC", "3600"))
+	deleteWindow, _ := strconv.Atoi(getenv("MESSAGE_DELETE_WINDOW_MIN", "60"))
+	attachMax, _ := strconv.Atoi(getenv("ATTACHMENT_MAX_MB", "10"))
+	attachTTL, _ := strconv.Atoi(getenv("ATTACHMENT_UNCLAIMED_TTL_MIN", "1440"))
+	attachUnclaimed, _ := strconv.Atoi(getenv("ATTACHMENT_MAX_UNCLAIMED", "20"))
+	eventRetention, _ := strconv.Atoi(getenv("EVENT_RETENTION_HOURS", "168"))
 
 	cfg := Config{
 		Addr:           getenv("HTTP_ADDR", ":8080"),
 		JWTSecret:      getenv("JWT_SECRET", ""),
 		JWTTTLMin:      jwtttl,
-		PostgresDSN:    getenv("DATABASE_URL", ""),
-		OTPDigits:      otpdigit,
-		OTPTTLSec:      otpttl,
-		SendGridAPIKey: getenv("SENDGRID_API_KEY", ""),
-		SendGridFrom:   getenv("SENDGRID_FROM", ""),
+		RefreshTTLDays: refreshttl,
+
+		AuthTokenSources: getenv("AUTH_TOKEN_SOURCES", "header,cookie,query"),
+		PostgresDSN:      getenv("DATABASE_URL", ""),
+		OTPDigits:        otpdigit,
+		OTPTTLSec:        otpttl,
+		SendGridAPIKey:   getenv("SENDGRID_API_KEY", ""),
+		SendGridFrom:     getenv("SENDGRID_FROM", ""),
+		OTPMaxAttempts:   otpattempts,
+		LoginMaxFailures: loginfailures,
+		IPMaxFailures:    ipfailures,
+		LockoutBaseSec:   lockoutbase,
+		LockoutMaxSec:    lockoutmax,
+
+		DeleteWindowMin: deleteWindow,
+		AttachmentsDir:  getenv("ATTACHMENTS_DIR", "uploads"),
+		AttachmentMaxMB: attachMax,
+
+		AttachmentUnclaimedTTLMin: attachTTL,
+		AttachmentMaxUnclaimed:    attachUnclaimed,
+
+		EventRetentionHours: eventRetention,
+		Broker:              getenv("BROKER", "memory"),
+		TrustedProxies:      splitList(getenv("TRUSTED_PROXIES", "")),
+		DebugAddr:           getenv("DEBUG_ADDR", ""),
 	}
 	return cfg
 }
@@ -10,6 +10,7 @@ import (
 	"github.com/ageniuscoder/mmchat/backend/internal/auth"
 	"github.com/ageniuscoder/mmchat/backend/internal/chat"
 	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/roles"
 	"github.com/ageniuscoder/mmchat/backend/internal/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -42,8 +43,19 @@ func Register(rg *gin.RouterGroup, db *sql.DB, hub *chat.Hub) {
 	rg.POST("/conversations/group", s.createGroup)
 	rg.POST("/conversations/:id/participants", s.addParticipant)
 	rg.DELETE("/conversations/:id/participants/:userId", s.removeParticipant)
+	rg.PATCH("/conversations/:id/participants/:userId", s.setRole)
+	rg.POST("/conversations/:id/leave", s.leave)
 	rg.GET("/conversations", s.listMine)
+	rg.GET("/conversations/:id", s.get)
+	rg.PATCH("/conversations/:id", s.updateInfo)
+	rg.PATCH("/conversations/:id/permissions", s.updatePermissions)
+	rg.PATCH("/conversations/:id/settings", s.updateSettings)
 	rg.GET("/conversations/:id/participants", s.listParticipants)
+	rg.POST("/conversations/:id/invites", s.createInvite)
+	rg.GET("/conversations/:id/invites", s.listInvites)
+	rg.DELETE("/conversations/:id/invites/:inviteId", s.revokeInvite)
+	rg.GET("/invites/:token", s.previewInvite)
+	rg.POST("/invites/:token/join", s.joinInvite)
 }
 
 func (s *Service) createOrGetPrivate(c *gin.Context) {
@@ -91,7 +103,7 @@ func (s *Service) createOrGetPrivate(c *gin.Context) {
 	}
 
 	// add participants (this will fail if user doesn't exist because of FK)
-	_, err = tx.Exec(`INSERT INTO participants (conversation_id, user_id, is_admin) VALUES ($1, $2, FALSE), ($3, $4, FALSE)`,
+	_, err = tx.Exec(`INSERT INTO participants (conversation_id, user_id) VALUES ($1, $2), ($3, $4)`,
 		conversationID, uid, conversationID, req.OtherUserId)
 	if err != nil {
 		fmt.Println("Insert participants error:", err)
@@ -104,6 +116,7 @@ func (s *Service) createOrGetPrivate(c *gin.Context) {
 		httpx.Err(c, 500, "commit failed")
 		return
 	}
+	s.Hub.InvalidateConversation(conversationID)
 	s.Hub.BroadcastConversationUpdate(conversationID, "new_conversation") // Notify participants of new conversation
 
 	httpx.OK(c, gin.H{"success": true, "conversation_id": conversationID, "is_group": false})
@@ -138,8 +151,8 @@ func (s *Service) createGroup(c *gin.Context) {
 		return
 	}
 
-	// insert creator as admin
-	_, err = tx.Exec(`INSERT INTO participants (conversation_id, user_id, is_admin) VALUES ($1, $2, TRUE)`, cid, uid)
+	// insert creator as owner
+	_, err = tx.Exec(`INSERT INTO participants (conversation_id, user_id, role) VALUES ($1, $2, $3)`, cid, uid, roles.Owner)
 	if err != nil {
 		httpx.Err(c, 400, "add creator failed")
 		return
@@ -163,7 +176,7 @@ func (s *Service) createGroup(c *gin.Context) {
 			continue // skip invalid user
 		}
 
-		_, err = tx.Exec(`INSERT INTO participants (conversation_id, user_id, is_admin) VALUES ($1, $2, FALSE) ON CONFLICT DO NOTHING`, cid, mid)
+		_, err = insertParticipant(tx, cid, mid)
 		if err != nil {
 			httpx.Err(c, 400, "add member failed")
 			return
@@ -182,6 +195,7 @@ func (s *Service) createGroup(c *gin.Context) {
 		httpx.Err(c, 500, "commit failed")
 		return
 	}
+	s.Hub.InvalidateConversation(cid)
 	var username string
 	_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, uid).Scan(&username)
 
@@ -197,11 +211,7 @@ func (s Service) addParticipant(c *gin.Context) {
 	cid := c.Param("id")
 	ncid, _ := strconv.ParseInt(cid, 10, 64) // Convert cid to int64
 
-	//ensure uid is admin
-	var n int
-	_ = s.DB.QueryRow(`SELECT COUNT(1) FROM participants WHERE conversation_id=$1 AND user_id=$2 AND is_admin=TRUE`, cid, uid).Scan(&n)
-	if n == 0 {
-		httpx.Err(c, http.StatusForbidden, "only admin can add participants")
+	if _, ok := s.authorize(c, ncid, uid, roles.AddMembers); !ok {
 		return
 	}
 
@@ -215,15 +225,14 @@ func (s Service) addParticipant(c *gin.Context) {
 		return
 	}
 
-	_, err := s.DB.Exec(`INSERT INTO participants (conversation_id, user_id, is_admin) VALUES ($1, $2, FALSE) ON CONFLICT DO NOTHING`, cid, req.UserID)
-	var removedUsername string
-	_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, req.UserID).Scan(&removedUsername)
+	added, err := insertParticipant(s.DB, ncid, req.UserID)
 	if err != nil {
 		httpx.Err(c, 400, "add failed")
 		return
 	}
-	s.Hub.BroadcastSystemMessage(ncid, fmt.Sprintf("%s has been added to the group.", removedUsername))
-	s.Hub.BroadcastConversationUpdate(ncid, "added_to_conversation") // Notify the added user
+	if added {
+		s.announceMember(ncid, req.UserID, "%s has been added to the group.")
+	}
 	httpx.OK(c, gin.H{"success": true})
 }
 
@@ -232,10 +241,9 @@ func (s Service) removeParticipant(c *gin.Context) {
 	cid := c.Param("id")
 	ncid, _ := strconv.ParseInt(cid, 10, 64)
 
-	var isAdmin bool
-	_ = s.DB.QueryRow(`SELECT is_admin FROM participants WHERE conversation_id=$1 AND user_id=$2`, cid, uid).Scan(&isAdmin)
-	if !isAdmin {
-		httpx.Err(c, http.StatusForbidden, "only admin can remove participants")
+	// whoever may add members may also remove those ranked below them
+	m, ok := s.authorize(c, ncid, uid, roles.AddMembers)
+	if !ok {
 		return
 	}
 
@@ -244,17 +252,27 @@ func (s Service) removeParticipant(c *gin.Context) {
 		httpx.Err(c, http.StatusForbidden, "cannot remove yourself")
 		return
 	}
+	removedRole, err := roles.Of(s.DB, ncid, removedUserId)
+	if err != nil {
+		httpx.Err(c, http.StatusNotFound, "user is not a participant")
+		return
+	}
+	if !m.Role.Outranks(removedRole) {
+		httpx.Err(c, http.StatusForbidden, "cannot remove a member ranked equal to or above you")
+		return
+	}
 
 	// Get the removed user's username
 	var removedUsername string
 	_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, removedUserId).Scan(&removedUsername)
 
 	// Delete the participant
-	_, err := s.DB.Exec(`DELETE FROM participants WHERE conversation_id=$1 AND user_id=$2`, cid, removedUserId)
+	_, err = s.DB.Exec(`DELETE FROM participants WHERE conversation_id=$1 AND user_id=$2`, cid, removedUserId)
 	if err != nil {
 		httpx.Err(c, 400, "remove failed")
 		return
 	}
+	s.Hub.InvalidateConversation(ncid)
 
 	// Send the system message to the chat
 	s.Hub.BroadcastSystemMessage(ncid, fmt.Sprintf("%s has been removed from the group.", removedUsername))
@@ -265,8 +283,12 @@ func (s Service) removeParticipant(c *gin.Context) {
 	httpx.OK(c, gin.H{"success": true})
 }
 
+// listMine lists the caller's conversations, archived ones only with
+// ?archived=true and otherwise the rest. Pinned conversations come first in
+// pin order, then the most recently active.
 func (s Service) listMine(c *gin.Context) {
 	uid := auth.MustUserID(c)
+	archived := c.Query("archived") == "true"
 
 	rows, err := s.DB.Query(`
 		SELECT
@@ -275,27 +297,45 @@ func (s Service) listMine(c *gin.Context) {
 			c.is_group_chat,
 			c.created_at,
 			CASE WHEN c.is_group_chat = FALSE THEN other_user.username ELSE c.name END as display_name,
-			CASE WHEN c.is_group_chat = FALSE THEN other_user.profile_pic ELSE NULL END as avatar,
+			CASE WHEN c.is_group_chat = FALSE THEN other_user.profile_pic ELSE c.avatar END as avatar,
+			c.description,
+			p1.role,
+			c.perm_post,
+			c.announcement_only,
+			c.slow_mode_sec,
+			p1.muted_until,
+			p1.archived,
+			p1.pin_order,
 			CASE WHEN c.is_group_chat = FALSE THEN other_user.last_active ELSE NULL END as last_active,
 			CASE WHEN c.is_group_chat = FALSE THEN other_user.id ELSE NULL END as other_user_id,
 			(SELECT COUNT(1) FROM participants WHERE conversation_id = c.id) AS participant_count,
-			(SELECT m.content FROM messages m WHERE m.conversation_id = c.id ORDER BY m.sent_at DESC LIMIT 1) AS last_message,
-			(SELECT m.sent_at FROM messages m WHERE m.conversation_id = c.id ORDER BY m.sent_at DESC LIMIT 1) AS last_message_at,
+			(SELECT CASE WHEN m.is_deleted THEN '' ELSE m.content END FROM messages m WHERE m.conversation_id = c.id
+				AND NOT EXISTS(SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+				ORDER BY m.sent_at DESC LIMIT 1) AS last_message,
+			(SELECT m.sent_at FROM messages m WHERE m.conversation_id = c.id
+				AND NOT EXISTS(SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+				ORDER BY m.sent_at DESC LIMIT 1) AS last_message_at,
+			(SELECT m.is_deleted FROM messages m WHERE m.conversation_id = c.id
+				AND NOT EXISTS(SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+				ORDER BY m.sent_at DESC LIMIT 1) AS last_message_deleted,
 			COALESCE((
 				SELECT COUNT(m.id)
 				FROM messages m
 				LEFT JOIN message_status ms ON m.id = ms.message_id AND ms.user_id = $1
 				WHERE m.conversation_id = c.id
 				AND m.sender_id != $2
+				AND m.is_deleted = FALSE
+				AND NOT EXISTS(SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
 				AND ms.status IS DISTINCT FROM 'read'   --just changed here
 			), 0) AS unread_count
 		FROM conversations c
 		JOIN participants p1 ON p1.conversation_id = c.id
 		LEFT JOIN participants p2 ON c.is_group_chat = FALSE AND p2.conversation_id = c.id AND p2.user_id != p1.user_id
 		LEFT JOIN users other_user ON p2.user_id = other_user.id
-		WHERE p1.user_id = $3
-		GROUP BY c.id, c.name, c.is_group_chat, c.created_at, display_name, avatar, last_active, other_user_id
-		ORDER BY last_message_at DESC NULLS LAST, c.created_at DESC`, uid, uid, uid)
+		WHERE p1.user_id = $3 AND p1.archived = $4
+		GROUP BY c.id, c.name, c.is_group_chat, c.created_at, display_name, avatar, c.description, p1.role, c.perm_post, c.announcement_only, c.slow_mode_sec,
+			p1.muted_until, p1.archived, p1.pin_order, last_active, other_user_id
+		ORDER BY p1.pin_order ASC NULLS LAST, last_message_at DESC NULLS LAST, c.created_at DESC`, uid, uid, uid, archived)
 	if err != nil {
 		httpx.Err(c, http.StatusInternalServerError, "failed to fetch conversations")
 		return
@@ -312,15 +352,24 @@ func (s Service) listMine(c *gin.Context) {
 			ca               time.Time // Use time.Time directly for PostgreSQL TIMESTAMP WITH TIME ZONE
 			displayName      sql.NullString
 			avatar           sql.NullString
+			description      sql.NullString
+			role             roles.Role
+			postRole         roles.Role
+			announcementOnly bool
+			slowModeSec      int
+			mutedUntil       sql.NullTime
+			isArchived       bool
+			pinOrder         sql.NullInt64
 			lastActive       sql.NullTime
 			otherUserId      sql.NullInt64
 			participantCount int64
 			lastMessage      sql.NullString
 			lastMessageAt    sql.NullTime
+			lastMessageDel   sql.NullBool
 			unreadCount      int64
 		)
 
-		if err := rows.Scan(&id, &name, &isg, &ca, &displayName, &avatar, &lastActive, &otherUserId, &participantCount, &lastMessage, &lastMessageAt, &unreadCount); err != nil {
+		if err := rows.Scan(&id, &name, &isg, &ca, &displayName, &avatar, &description, &role, &postRole, &announcementOnly, &slowModeSec, &mutedUntil, &isArchived, &pinOrder, &lastActive, &otherUserId, &participantCount, &lastMessage, &lastMessageAt, &lastMessageDel, &unreadCount); err != nil {
 			fmt.Printf("listMine: failed to scan row: %v\n", err)
 			continue
 		}
@@ -341,9 +390,22 @@ func (s Service) listMine(c *gin.Context) {
 			"participant_count": participantCount,
 			"unread_count":      unreadCount,
 			"avatar":            avatar.String,
+			"description":       description.String,
+			"role":              role,
 			"is_online":         isOnline,
 		}
 
+		// posting limits, so clients can disable the composer up front
+		m := roles.Membership{Role: role, IsGroup: isg, Perms: roles.Set{roles.Post: postRole}, AnnouncementOnly: announcementOnly, SlowModeSec: slowModeSec}
+		conversation["can_post"] = m.Can(roles.Post)
+		if isg {
+			conversation["announcement_only"] = announcementOnly
+			conversation["slow_mode_sec"] = m.SlowMode()
+		}
+		for k, v := range settingsJSON(mutedUntil, isArchived, pinOrder) {
+			conversation[k] = v
+		}
+
 		if otherUserId.Valid {
 			conversation["other_user_id"] = otherUserId.Int64
 		}
@@ -361,6 +423,7 @@ func (s Service) listMine(c *gin.Context) {
 			conversation["last_message"] = gin.H{
 				"content":    lastMessage.String,
 				"created_at": lastMessageAt.Time.UTC().Format(time.RFC3339),
+				"is_deleted": lastMessageDel.Bool,
 			}
 		}
 
@@ -388,7 +451,7 @@ func (s *Service) listParticipants(c *gin.Context) {
 	}
 
 	rows, err := s.DB.Query(`
-		SELECT u.id, u.username, u.profile_pic, p.is_admin
+		SELECT u.id, u.username, u.profile_pic, p.role
 		FROM participants p
 		JOIN users u ON p.user_id = u.id
 		WHERE p.conversation_id=$1`, cid)
@@ -403,15 +466,16 @@ func (s *Service) listParticipants(c *gin.Context) {
 		var id int64
 		var username string
 		var profilePic sql.NullString
-		var isAdmin bool
-		if err := rows.Scan(&id, &username, &profilePic, &isAdmin); err != nil {
+		var role roles.Role
+		if err := rows.Scan(&id, &username, &profilePic, &role); err != nil {
 			continue
 		}
 		participants = append(participants, gin.H{
 			"id":              id,
 			"username":        username,
 			"profile_picture": profilePic.String,
-			"is_admin":        isAdmin,
+			"role":            role,
+			"is_admin":        role.AtLeast(roles.Admin),
 		})
 	}
 
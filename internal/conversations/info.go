@@ -0,0 +1,265 @@
+package conversations
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/roles"
+	"github.com/ageniuscoder/mmchat/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// infoReq changes group settings; omitted fields are left alone and an empty
+// description or avatar clears it.
+type infoReq struct {
+	Name        *string `json:"name" binding:"omitempty,max=100"`
+	Description *string `json:"description" binding:"omitempty,max=500"`
+	Avatar      *string `json:"avatar" binding:"omitempty,max=1000"`
+}
+
+// get returns a single conversation the caller belongs to. For private chats
+// name and avatar are the other user's, as in listMine.
+func (s Service) get(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+
+	m, err := roles.Load(s.DB, cid, uid)
+	if err == roles.ErrNotMember {
+		httpx.Err(c, http.StatusForbidden, "not a member of this conversation")
+		return
+	}
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	var (
+		name, desc, pic  sql.NullString
+		createdAt        time.Time
+		participantCount int64
+		otherUserID      sql.NullInt64
+	)
+	err = s.DB.QueryRow(`
+		SELECT
+			CASE WHEN c.is_group_chat THEN c.name ELSE other_user.username END,
+			c.description,
+			CASE WHEN c.is_group_chat THEN c.avatar ELSE other_user.profile_pic END,
+			c.created_at,
+			(SELECT COUNT(1) FROM participants WHERE conversation_id = c.id),
+			other_user.id
+		FROM conversations c
+		LEFT JOIN participants p2 ON c.is_group_chat = FALSE AND p2.conversation_id = c.id AND p2.user_id != $1
+		LEFT JOIN users other_user ON other_user.id = p2.user_id
+		WHERE c.id = $2`, uid, cid).Scan(&name, &desc, &pic, &createdAt, &participantCount, &otherUserID)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	conversation := gin.H{
+		"id":                cid,
+		"name":              name.String,
+		"description":       desc.String,
+		"avatar":            pic.String,
+		"is_group":          m.IsGroup,
+		"role":              m.Role,
+		"is_admin":          m.Role.AtLeast(roles.Admin),
+		"participant_count": participantCount,
+		"created_at":        createdAt.UTC().Format(time.RFC3339),
+	}
+	if otherUserID.Valid {
+		conversation["other_user_id"] = otherUserID.Int64
+	}
+	if m.IsGroup {
+		conversation["permissions"] = m.Perms
+		conversation["announcement_only"] = m.AnnouncementOnly
+		conversation["slow_mode_sec"] = m.SlowModeSec
+	}
+	conversation["can_post"] = m.Can(roles.Post)
+	httpx.OK(c, gin.H{"success": true, "conversation": conversation})
+}
+
+// updateInfo lets members holding edit_info rename a group and set its description and avatar.
+func (s Service) updateInfo(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	var req infoReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok {
+			httpx.Err(c, http.StatusBadRequest, utils.ValidationErr(validationErrors))
+			return
+		}
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.Name != nil {
+		trimmed := strings.TrimSpace(*req.Name)
+		if trimmed == "" {
+			httpx.Err(c, http.StatusBadRequest, "name cannot be empty")
+			return
+		}
+		req.Name = &trimmed
+	}
+	if req.Name == nil && req.Description == nil && req.Avatar == nil {
+		httpx.Err(c, http.StatusBadRequest, "nothing to update")
+		return
+	}
+
+	if _, ok := s.authorize(c, cid, uid, roles.EditInfo); !ok {
+		return
+	}
+
+	// COALESCE keeps columns whose field was omitted; NULLIF stores "" as NULL
+	_, err = s.DB.Exec(`
+		UPDATE conversations SET
+			name = COALESCE($1, name),
+			description = CASE WHEN $2::TEXT IS NULL THEN description ELSE NULLIF($2, '') END,
+			avatar = CASE WHEN $3::TEXT IS NULL THEN avatar ELSE NULLIF($3, '') END
+		WHERE id = $4`, req.Name, req.Description, req.Avatar, cid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "update failed")
+		return
+	}
+
+	var username string
+	_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, uid).Scan(&username)
+	if req.Name != nil {
+		s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s renamed the group to '%s'.", username, *req.Name))
+	}
+	if req.Description != nil {
+		s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s changed the group description.", username))
+	}
+	if req.Avatar != nil {
+		s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s changed the group avatar.", username))
+	}
+	s.Hub.BroadcastConversationUpdate(cid, "group_info_updated")
+
+	s.get(c)
+}
+
+// permissionsReq sets the least role for each permission and the posting
+// limits; omitted fields are left alone.
+type permissionsReq struct {
+	Post           *roles.Role `json:"post" binding:"omitempty,oneof=owner admin moderator member read_only"`
+	AddMembers     *roles.Role `json:"add_members" binding:"omitempty,oneof=owner admin moderator member read_only"`
+	EditInfo       *roles.Role `json:"edit_info" binding:"omitempty,oneof=owner admin moderator member read_only"`
+	Pin            *roles.Role `json:"pin" binding:"omitempty,oneof=owner admin moderator member read_only"`
+	DeleteMessages *roles.Role `json:"delete_messages" binding:"omitempty,oneof=owner admin moderator member read_only"`
+
+	AnnouncementOnly *bool `json:"announcement_only"`
+	SlowModeSec      *int  `json:"slow_mode_sec" binding:"omitempty,min=0,max=86400"`
+}
+
+// updatePermissions lets the owner and admins choose who may do what in a
+// group and set its posting limits. Nobody can require a role above their
+// own, so admins cannot lock themselves out.
+func (s Service) updatePermissions(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	var req permissionsReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok {
+			httpx.Err(c, http.StatusBadRequest, utils.ValidationErr(validationErrors))
+			return
+		}
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	changes := roles.Set{}
+	for p, r := range map[roles.Permission]*roles.Role{
+		roles.Post:           req.Post,
+		roles.AddMembers:     req.AddMembers,
+		roles.EditInfo:       req.EditInfo,
+		roles.Pin:            req.Pin,
+		roles.DeleteMessages: req.DeleteMessages,
+	} {
+		if r != nil {
+			changes[p] = *r
+		}
+	}
+	if len(changes) == 0 && req.AnnouncementOnly == nil && req.SlowModeSec == nil {
+		httpx.Err(c, http.StatusBadRequest, "nothing to update")
+		return
+	}
+
+	m, err := roles.Load(s.DB, cid, uid)
+	if err != nil || !m.Role.AtLeast(roles.Admin) {
+		httpx.Err(c, http.StatusForbidden, "only the owner and admins can change permissions")
+		return
+	}
+	if !m.IsGroup {
+		httpx.Err(c, http.StatusBadRequest, "private conversations have no permissions")
+		return
+	}
+
+	var sets []string
+	var args []any
+	for _, p := range roles.Permissions {
+		r, ok := changes[p]
+		if !ok {
+			continue
+		}
+		if r.Outranks(m.Role) {
+			httpx.Err(c, http.StatusForbidden, fmt.Sprintf("cannot require a role above your own for %s", p))
+			return
+		}
+		args = append(args, r)
+		sets = append(sets, fmt.Sprintf("%s = $%d", p.Column(), len(args)))
+	}
+	if req.AnnouncementOnly != nil {
+		args = append(args, *req.AnnouncementOnly)
+		sets = append(sets, fmt.Sprintf("announcement_only = $%d", len(args)))
+	}
+	if req.SlowModeSec != nil {
+		args = append(args, *req.SlowModeSec)
+		sets = append(sets, fmt.Sprintf("slow_mode_sec = $%d", len(args)))
+	}
+	args = append(args, cid)
+	_, err = s.DB.Exec(fmt.Sprintf(`UPDATE conversations SET %s WHERE id = $%d`, strings.Join(sets, ", "), len(args)), args...)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "update failed")
+		return
+	}
+
+	var username string
+	_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, uid).Scan(&username)
+	if len(changes) > 0 {
+		s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s changed the group permissions.", username))
+	}
+	if req.AnnouncementOnly != nil {
+		if *req.AnnouncementOnly {
+			s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s made the group announcement-only. Only admins can post.", username))
+		} else {
+			s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s allowed everyone to post again.", username))
+		}
+	}
+	if req.SlowModeSec != nil {
+		if *req.SlowModeSec > 0 {
+			s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s turned on slow mode: one message every %d seconds.", username, *req.SlowModeSec))
+		} else {
+			s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s turned off slow mode.", username))
+		}
+	}
+	s.Hub.BroadcastConversationUpdate(cid, "permissions_updated")
+
+	s.get(c)
+}
@@ -0,0 +1,266 @@
+package conversations
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/roles"
+	"github.com/ageniuscoder/mmchat/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+type inviteReq struct {
+	// ExpiresInHours and MaxUses are optional; zero means no limit.
+	ExpiresInHours int `json:"expires_in_hours" binding:"omitempty,min=1,max=8760"`
+	MaxUses        int `json:"max_uses" binding:"omitempty,min=1"`
+}
+
+// insertParticipant adds userID to a conversation as a member. It
+// reports false when the user already was a participant.
+func insertParticipant(q execer, cid, userID int64) (bool, error) {
+	res, err := q.Exec(`INSERT INTO participants (conversation_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, cid, userID)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// announceMember tells the group, including the new member, that userID
+// joined. format receives the username.
+func (s Service) announceMember(cid, userID int64, format string) {
+	s.Hub.InvalidateConversation(cid)
+	var username string
+	_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, userID).Scan(&username)
+	s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf(format, username))
+	s.Hub.BroadcastConversationUpdate(cid, "added_to_conversation") // Notify the added user
+}
+
+func newInviteToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func (s Service) createInvite(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	var req inviteReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok {
+			httpx.Err(c, http.StatusBadRequest, utils.ValidationErr(validationErrors))
+			return
+		}
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if _, ok := s.authorize(c, cid, uid, roles.AddMembers); !ok {
+		return
+	}
+
+	token, err := newInviteToken()
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "failed to generate invite")
+		return
+	}
+	var expiresAt sql.NullTime
+	if req.ExpiresInHours > 0 {
+		expiresAt = sql.NullTime{Time: time.Now().Add(time.Duration(req.ExpiresInHours) * time.Hour), Valid: true}
+	}
+	maxUses := sql.NullInt64{Int64: int64(req.MaxUses), Valid: req.MaxUses > 0}
+
+	var id int64
+	var createdAt time.Time
+	err = s.DB.QueryRow(`
+		INSERT INTO conversation_invites (conversation_id, token, created_by, expires_at, max_uses)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id, created_at`,
+		cid, token, uid, expiresAt, maxUses).Scan(&id, &createdAt)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "failed to create invite")
+		return
+	}
+	httpx.OK(c, gin.H{"success": true, "invite": inviteJSON(id, token, uid, expiresAt, maxUses, 0, createdAt)})
+}
+
+// listInvites returns the conversation's invites that can still be used.
+func (s Service) listInvites(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	if _, ok := s.authorize(c, cid, uid, roles.AddMembers); !ok {
+		return
+	}
+
+	rows, err := s.DB.Query(`
+		SELECT id, token, created_by, expires_at, max_uses, use_count, created_at
+		FROM conversation_invites
+		WHERE conversation_id=$1 AND revoked_at IS NULL
+		AND (expires_at IS NULL OR expires_at > NOW())
+		AND (max_uses IS NULL OR use_count < max_uses)
+		ORDER BY created_at DESC`, cid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	invites := []gin.H{}
+	for rows.Next() {
+		var id, createdBy int64
+		var token string
+		var expiresAt sql.NullTime
+		var maxUses sql.NullInt64
+		var useCount int64
+		var createdAt time.Time
+		if err := rows.Scan(&id, &token, &createdBy, &expiresAt, &maxUses, &useCount, &createdAt); err != nil {
+			fmt.Printf("listInvites: failed to scan row: %v\n", err)
+			continue
+		}
+		invites = append(invites, inviteJSON(id, token, createdBy, expiresAt, maxUses, useCount, createdAt))
+	}
+	httpx.OK(c, gin.H{"success": true, "invites": invites})
+}
+
+func (s Service) revokeInvite(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	inviteID, err := strconv.ParseInt(c.Param("inviteId"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid invite id")
+		return
+	}
+	if _, ok := s.authorize(c, cid, uid, roles.AddMembers); !ok {
+		return
+	}
+	res, err := s.DB.Exec(`UPDATE conversation_invites SET revoked_at=NOW() WHERE id=$1 AND conversation_id=$2 AND revoked_at IS NULL`, inviteID, cid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "revoke failed")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpx.Err(c, http.StatusNotFound, "invite not found")
+		return
+	}
+	httpx.OK(c, gin.H{"success": true})
+}
+
+// previewInvite shows what a link leads to before joining. Unusable links
+// (revoked, expired, used up) are reported as not found.
+func (s Service) previewInvite(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	var (
+		cid              int64
+		name, desc, pic  sql.NullString
+		participantCount int64
+		isMember         bool
+	)
+	err := s.DB.QueryRow(`
+		SELECT c.id, c.name, c.description, c.avatar,
+			(SELECT COUNT(1) FROM participants WHERE conversation_id = c.id),
+			EXISTS(SELECT 1 FROM participants WHERE conversation_id = c.id AND user_id = $2)
+		FROM conversation_invites i
+		JOIN conversations c ON c.id = i.conversation_id
+		WHERE i.token=$1 AND i.revoked_at IS NULL
+		AND (i.expires_at IS NULL OR i.expires_at > NOW())
+		AND (i.max_uses IS NULL OR i.use_count < i.max_uses)`, c.Param("token"), uid).
+		Scan(&cid, &name, &desc, &pic, &participantCount, &isMember)
+	if err != nil {
+		httpx.Err(c, http.StatusNotFound, "invite is invalid or has expired")
+		return
+	}
+	httpx.OK(c, gin.H{
+		"success":           true,
+		"conversation_id":   cid,
+		"name":              name.String,
+		"description":       desc.String,
+		"avatar":            pic.String,
+		"participant_count": participantCount,
+		"already_member":    isMember,
+	})
+}
+
+// joinInvite adds the caller to the invite's group and counts the use.
+// Joining a group one already belongs to does not consume a use.
+func (s Service) joinInvite(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	token := c.Param("token")
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "db transaction failed")
+		return
+	}
+	defer tx.Rollback()
+
+	// the guarded increment both validates the invite and claims a use
+	var cid int64
+	err = tx.QueryRow(`
+		UPDATE conversation_invites SET use_count = use_count + 1
+		WHERE token=$1 AND revoked_at IS NULL
+		AND (expires_at IS NULL OR expires_at > NOW())
+		AND (max_uses IS NULL OR use_count < max_uses)
+		RETURNING conversation_id`, token).Scan(&cid)
+	if err != nil {
+		httpx.Err(c, http.StatusNotFound, "invite is invalid or has expired")
+		return
+	}
+	added, err := insertParticipant(tx, cid, uid)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "join failed")
+		return
+	}
+	if !added {
+		httpx.OK(c, gin.H{"success": true, "conversation_id": cid, "already_member": true})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "commit failed")
+		return
+	}
+	s.announceMember(cid, uid, "%s joined the group via invite link.")
+	httpx.OK(c, gin.H{"success": true, "conversation_id": cid, "already_member": false})
+}
+
+func inviteJSON(id int64, token string, createdBy int64, expiresAt sql.NullTime, maxUses sql.NullInt64, useCount int64, createdAt time.Time) gin.H {
+	invite := gin.H{
+		"id":         id,
+		"token":      token,
+		"created_by": createdBy,
+		"expires_at": nil,
+		"max_uses":   nil,
+		"use_count":  useCount,
+		"created_at": createdAt.UTC().Format(time.RFC3339),
+	}
+	if expiresAt.Valid {
+		invite["expires_at"] = expiresAt.Time.UTC().Format(time.RFC3339)
+	}
+	if maxUses.Valid {
+		invite["max_uses"] = maxUses.Int64
+	}
+	return invite
+}
@@ -0,0 +1,263 @@
+package conversations
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/roles"
+	"github.com/ageniuscoder/mmchat/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// authorize loads the caller's membership of group cid and, unless it
+// grants p, writes the error response and returns false.
+func (s Service) authorize(c *gin.Context, cid, uid int64, p roles.Permission) (roles.Membership, bool) {
+	m, err := roles.Load(s.DB, cid, uid)
+	if err == roles.ErrNotMember {
+		httpx.Err(c, http.StatusForbidden, "not a member of this group")
+		return m, false
+	}
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return m, false
+	}
+	if !m.IsGroup {
+		httpx.Err(c, http.StatusBadRequest, "not a group conversation")
+		return m, false
+	}
+	if !m.Can(p) {
+		httpx.Err(c, http.StatusForbidden, fmt.Sprintf("your role does not allow %s", p))
+		return m, false
+	}
+	return m, true
+}
+
+// roleTitle completes "<username> is now ..." announcements.
+var roleTitle = map[roles.Role]string{
+	roles.Owner:     "the owner",
+	roles.Admin:     "an admin",
+	roles.Moderator: "a moderator",
+	roles.Member:    "a member",
+	roles.ReadOnly:  "read-only",
+}
+
+// leave removes the caller from a group. When the owner leaves, the highest
+// ranked remaining member (earliest to join among equals) becomes owner; when
+// the last member leaves, the conversation is deleted.
+func (s Service) leave(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "db transaction failed")
+		return
+	}
+	defer tx.Rollback()
+
+	// lock the member list so concurrent leaves see each other before the
+	// successor is picked
+	if _, err := tx.Exec(`SELECT 1 FROM participants WHERE conversation_id=$1 FOR UPDATE`, cid); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	m, err := roles.Load(tx, cid, uid)
+	if err == roles.ErrNotMember {
+		httpx.Err(c, http.StatusForbidden, "not a member of this group")
+		return
+	}
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if !m.IsGroup {
+		httpx.Err(c, http.StatusBadRequest, "cannot leave a private conversation")
+		return
+	}
+
+	if _, err := tx.Exec(`DELETE FROM participants WHERE conversation_id=$1 AND user_id=$2`, cid, uid); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "leave failed")
+		return
+	}
+
+	var remaining int
+	if err := tx.QueryRow(`SELECT COUNT(1) FROM participants WHERE conversation_id=$1`, cid).Scan(&remaining); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	deleted := remaining == 0
+	var newOwner sql.NullInt64
+	if deleted {
+		if _, err := tx.Exec(`DELETE FROM conversations WHERE id=$1`, cid); err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "failed to delete conversation")
+			return
+		}
+	} else if m.Role == roles.Owner {
+		err = tx.QueryRow(`
+			SELECT user_id FROM participants WHERE conversation_id=$1
+			ORDER BY CASE role WHEN 'admin' THEN 0 WHEN 'moderator' THEN 1 WHEN 'member' THEN 2 ELSE 3 END,
+				joined_at ASC, user_id ASC
+			LIMIT 1`, cid).Scan(&newOwner)
+		if err == nil {
+			_, err = tx.Exec(`UPDATE participants SET role=$1 WHERE conversation_id=$2 AND user_id=$3`, roles.Owner, cid, newOwner.Int64)
+		}
+		if err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "failed to hand over ownership")
+			return
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "commit failed")
+		return
+	}
+	s.Hub.InvalidateConversation(cid)
+
+	if !deleted {
+		var username string
+		_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, uid).Scan(&username)
+		s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s has left the group.", username))
+		if newOwner.Valid {
+			var ownerName string
+			_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, newOwner.Int64).Scan(&ownerName)
+			s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s is now %s.", ownerName, roleTitle[roles.Owner]))
+		}
+		s.Hub.BroadcastConversationUpdate(cid, "participant_left")
+	}
+	// the leaver is no longer a participant, so tell them directly
+	s.Hub.NotifyConversationUpdate(uid, cid, "left_conversation")
+
+	resp := gin.H{"success": true, "conversation_deleted": deleted}
+	if newOwner.Valid {
+		resp["new_owner_id"] = newOwner.Int64
+	}
+	httpx.OK(c, resp)
+}
+
+type roleReq struct {
+	// Role "owner" transfers ownership: the target becomes owner and the
+	// caller, who must be the owner, becomes an admin.
+	Role roles.Role `json:"role" binding:"required,oneof=owner admin moderator member read_only"`
+}
+
+// setRole changes a participant's role. Owners and admins may only change
+// members ranked below them and only to roles below their own; anyone but the
+// owner may step down themselves.
+func (s Service) setRole(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	target, err := strconv.ParseInt(c.Param("userId"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid user id")
+		return
+	}
+	var req roleReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok {
+			httpx.Err(c, http.StatusBadRequest, utils.ValidationErr(validationErrors))
+			return
+		}
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "db transaction failed")
+		return
+	}
+	defer tx.Rollback()
+
+	caller, err := roles.Load(tx, cid, uid)
+	if err != nil || !caller.Role.AtLeast(roles.Admin) {
+		httpx.Err(c, http.StatusForbidden, "only the owner and admins can change roles")
+		return
+	}
+	if !caller.IsGroup {
+		httpx.Err(c, http.StatusBadRequest, "private conversations have no roles")
+		return
+	}
+	targetRole, err := roles.Of(tx, cid, target)
+	if err != nil {
+		httpx.Err(c, http.StatusNotFound, "user is not a participant")
+		return
+	}
+
+	// each entry is a user whose role changes, in announcement order
+	type change struct {
+		userID   int64
+		from, to roles.Role
+	}
+	var changes []change
+	switch {
+	case req.Role == roles.Owner:
+		if caller.Role != roles.Owner || target == uid {
+			httpx.Err(c, http.StatusForbidden, "only the owner can transfer ownership to another member")
+			return
+		}
+		changes = append(changes, change{target, targetRole, roles.Owner}, change{uid, roles.Owner, roles.Admin})
+	case target == uid:
+		if caller.Role == roles.Owner {
+			httpx.Err(c, http.StatusConflict, "the owner must transfer ownership before stepping down")
+			return
+		}
+		if req.Role.Outranks(caller.Role) {
+			httpx.Err(c, http.StatusForbidden, "cannot promote yourself")
+			return
+		}
+	default:
+		if !caller.Role.Outranks(targetRole) {
+			httpx.Err(c, http.StatusForbidden, "cannot change the role of a member ranked equal to or above you")
+			return
+		}
+		if !caller.Role.Outranks(req.Role) {
+			httpx.Err(c, http.StatusForbidden, "cannot grant a role equal to or above your own")
+			return
+		}
+	}
+	if req.Role != roles.Owner && targetRole != req.Role {
+		changes = append(changes, change{target, targetRole, req.Role})
+	}
+	for _, ch := range changes {
+		if _, err := tx.Exec(`UPDATE participants SET role=$1 WHERE conversation_id=$2 AND user_id=$3`, ch.to, cid, ch.userID); err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "update failed")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "commit failed")
+		return
+	}
+
+	for _, ch := range changes {
+		var username string
+		_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, ch.userID).Scan(&username)
+		s.Hub.BroadcastSystemMessage(cid, fmt.Sprintf("%s is now %s.", username, roleTitle[ch.to]))
+		// clients written against the admin flag still listen for these
+		switch wasAdmin, isAdmin := ch.from.AtLeast(roles.Admin), ch.to.AtLeast(roles.Admin); {
+		case isAdmin && !wasAdmin:
+			s.Hub.BroadcastConversationUpdate(cid, "admin_granted")
+		case wasAdmin && !isAdmin:
+			s.Hub.BroadcastConversationUpdate(cid, "admin_revoked")
+		}
+	}
+	if len(changes) > 0 {
+		s.Hub.BroadcastConversationUpdate(cid, "role_changed")
+	}
+
+	httpx.OK(c, gin.H{"success": true, "user_id": target, "role": req.Role, "changed": len(changes) > 0})
+}
@@ -0,0 +1,143 @@
+package conversations
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// settingsReq changes the caller's own view of a conversation; omitted fields
+// are left alone. An empty muted_until unmutes.
+type settingsReq struct {
+	MutedUntil *string `json:"muted_until"`
+	Archived   *bool   `json:"archived"`
+	Pinned     *bool   `json:"pinned"`
+	// PinOrder places a pinned conversation; without it a newly pinned
+	// conversation goes after the caller's other pins.
+	PinOrder *int `json:"pin_order" binding:"omitempty,min=0"`
+}
+
+// updateSettings stores per-user mute, archive and pin settings.
+func (s Service) updateSettings(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	var req settingsReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok {
+			httpx.Err(c, http.StatusBadRequest, utils.ValidationErr(validationErrors))
+			return
+		}
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if req.MutedUntil == nil && req.Archived == nil && req.Pinned == nil && req.PinOrder == nil {
+		httpx.Err(c, http.StatusBadRequest, "nothing to update")
+		return
+	}
+	if req.PinOrder != nil && req.Pinned != nil && !*req.Pinned {
+		httpx.Err(c, http.StatusBadRequest, "pin_order requires pinned")
+		return
+	}
+	var mutedUntil sql.NullTime
+	if req.MutedUntil != nil && *req.MutedUntil != "" {
+		t, err := time.Parse(time.RFC3339, *req.MutedUntil)
+		if err != nil {
+			httpx.Err(c, http.StatusBadRequest, "muted_until must be an RFC3339 timestamp")
+			return
+		}
+		mutedUntil = sql.NullTime{Time: t, Valid: true}
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "db transaction failed")
+		return
+	}
+	defer tx.Rollback()
+
+	var pinOrder sql.NullInt64
+	err = tx.QueryRow(`SELECT pin_order FROM participants WHERE conversation_id=$1 AND user_id=$2 FOR UPDATE`, cid, uid).Scan(&pinOrder)
+	if err == sql.ErrNoRows {
+		httpx.Err(c, http.StatusForbidden, "not a member of this conversation")
+		return
+	}
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+
+	if req.MutedUntil != nil {
+		if _, err := tx.Exec(`UPDATE participants SET muted_until=$1 WHERE conversation_id=$2 AND user_id=$3`, mutedUntil, cid, uid); err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "update failed")
+			return
+		}
+	}
+	if req.Archived != nil {
+		if _, err := tx.Exec(`UPDATE participants SET archived=$1 WHERE conversation_id=$2 AND user_id=$3`, *req.Archived, cid, uid); err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "update failed")
+			return
+		}
+	}
+	switch {
+	case req.PinOrder != nil:
+		pinOrder = sql.NullInt64{Int64: int64(*req.PinOrder), Valid: true}
+	case req.Pinned != nil && *req.Pinned && !pinOrder.Valid:
+		err = tx.QueryRow(`SELECT COALESCE(MAX(pin_order) + 1, 0) FROM participants WHERE user_id=$1`, uid).Scan(&pinOrder)
+		if err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "database error")
+			return
+		}
+	case req.Pinned != nil && !*req.Pinned:
+		pinOrder = sql.NullInt64{}
+	}
+	if _, err := tx.Exec(`UPDATE participants SET pin_order=$1 WHERE conversation_id=$2 AND user_id=$3`, pinOrder, cid, uid); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "update failed")
+		return
+	}
+
+	var archived bool
+	err = tx.QueryRow(`SELECT muted_until, archived FROM participants WHERE conversation_id=$1 AND user_id=$2`, cid, uid).Scan(&mutedUntil, &archived)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "commit failed")
+		return
+	}
+	if req.MutedUntil != nil {
+		s.Hub.InvalidateConversation(cid)
+	}
+	// keep the caller's other devices in sync
+	s.Hub.NotifyConversationUpdate(uid, cid, "settings_updated")
+
+	httpx.OK(c, gin.H{"success": true, "conversation_id": cid, "settings": settingsJSON(mutedUntil, archived, pinOrder)})
+}
+
+func settingsJSON(mutedUntil sql.NullTime, archived bool, pinOrder sql.NullInt64) gin.H {
+	settings := gin.H{
+		"muted":       mutedUntil.Valid && mutedUntil.Time.After(time.Now()),
+		"muted_until": nil,
+		"archived":    archived,
+		"pinned":      pinOrder.Valid,
+		"pin_order":   nil,
+	}
+	if mutedUntil.Valid {
+		settings["muted_until"] = mutedUntil.Time.UTC().Format(time.RFC3339)
+	}
+	if pinOrder.Valid {
+		settings["pin_order"] = pinOrder.Int64
+	}
+	return settings
+}
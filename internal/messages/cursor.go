@@ -0,0 +1,52 @@
+package messages
+
+import (
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// cursor is a keyset position in a conversation, ordered by (sent_at, id) so
+// that messages sharing a timestamp still have a stable order.
+type cursor struct {
+	SentAt time.Time
+	ID     int64
+}
+
+var errBadCursor = errors.New("invalid cursor")
+
+// String encodes the cursor as an opaque, URL-safe token.
+func (c cursor) String() string {
+	raw := c.SentAt.UTC().Format(time.RFC3339Nano) + "|" + strconv.FormatInt(c.ID, 10)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func parseCursor(s string) (cursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return cursor{}, errBadCursor
+	}
+	at, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return cursor{}, errBadCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return cursor{}, errBadCursor
+	}
+	n, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return cursor{}, errBadCursor
+	}
+	return cursor{SentAt: t, ID: n}, nil
+}
+
+// token returns the encoded cursor, or nil so that it serialises as null.
+func token(c *cursor) any {
+	if c == nil {
+		return nil
+	}
+	return c.String()
+}
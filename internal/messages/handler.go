@@ -9,7 +9,9 @@ import (
 
 	"github.com/ageniuscoder/mmchat/backend/internal/auth"
 	"github.com/ageniuscoder/mmchat/backend/internal/chat"
+	"github.com/ageniuscoder/mmchat/backend/internal/config"
 	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/roles"
 	"github.com/ageniuscoder/mmchat/backend/internal/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
@@ -18,16 +20,40 @@ import (
 type Service struct {
 	DB  *sql.DB
 	Hub *chat.Hub
+	// DeleteWindow limits how long a sender may delete a message for everyone.
+	DeleteWindow time.Duration
+	// FullText selects Postgres tsvector search over the LIKE fallback.
+	FullText bool
 }
 
 type sendReq struct {
-	ConversationID int64  `json:"conversation_id"`
-	Content        string `json:"content"`
+	ConversationID   int64   `json:"conversation_id"`
+	Content          string  `json:"content"`
+	ReplyToMessageID *int64  `json:"reply_to_message_id"`
+	AttachmentIDs    []int64 `json:"attachment_ids"`
+	// ClientMessageID is generated by the client so retries are idempotent.
+	ClientMessageID string `json:"client_message_id" binding:"omitempty,max=64"`
 }
 
+// pageReq selects a window of messages. At most one of Before, After and
+// Around is honoured; without any of them the newest messages are returned.
 type pageReq struct {
-	Limit  int `form:"limit"`
-	Offset int `form:"offset"`
+	Limit  int    `form:"limit"`
+	Before string `form:"before"` // cursor: older than
+	After  string `form:"after"`  // cursor: newer than
+	Around int64  `form:"around"` // message id to centre the window on
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+func (q pageReq) limit() int {
+	if q.Limit <= 0 {
+		return defaultPageSize
+	}
+	return min(q.Limit, maxPageSize)
 }
 
 type readReq struct {
@@ -38,15 +64,29 @@ type editReq struct {
 	Content string `json:"content" binding:"required"`
 }
 
-func Register(rg *gin.RouterGroup, db *sql.DB, hub *chat.Hub) {
+// Register mounts the message routes and returns the service so it can also
+// serve WebSocket frames (see chat.MessageService).
+func Register(rg *gin.RouterGroup, db *sql.DB, hub *chat.Hub, cfg config.Config) Service {
 	s := Service{
-		DB:  db,
-		Hub: hub,
+		DB:           db,
+		Hub:          hub,
+		DeleteWindow: time.Duration(cfg.DeleteWindowMin) * time.Minute,
+		FullText:     usesFullText(db),
 	}
 	rg.POST("/messages", s.send)
 	rg.GET("/conversations/:id/messages", s.list)
 	rg.POST("/messages/read", s.markRead)
 	rg.PATCH("/messages/:id", s.edit) //for message edit
+	rg.DELETE("/messages/:id", s.delete)
+	rg.POST("/messages/:id/reactions", s.addReaction)
+	rg.DELETE("/messages/:id/reactions", s.removeReaction) //?emoji=
+	rg.GET("/messages/:id/thread", s.thread)
+	rg.GET("/messages/search", s.search)
+	rg.GET("/messages/:id/history", s.history)
+	rg.POST("/messages/:id/pin", s.pin)
+	rg.DELETE("/messages/:id/pin", s.unpin)
+	rg.GET("/conversations/:id/pins", s.pins)
+	return s
 }
 
 func (s Service) send(c *gin.Context) {
@@ -61,91 +101,122 @@ func (s Service) send(c *gin.Context) {
 		return
 	}
 
-	// authorize participant
-	var n int
-	_ = s.DB.QueryRow(`SELECT COUNT(1) FROM participants WHERE conversation_id=$1 AND user_id=$2`, req.ConversationID, uid).Scan(&n)
-	if n == 0 {
-		httpx.Err(c, http.StatusForbidden, "not a participant")
-		return
-	}
-
-	var mid int64
-	err := s.DB.QueryRow(`INSERT INTO messages (conversation_id, sender_id, content) VALUES ($1, $2, $3) RETURNING id`,
-		req.ConversationID, uid, req.Content).Scan(&mid)
+	res, err := s.sendMessage(uid, req)
 	if err != nil {
-		httpx.Err(c, 400, "insert failed")
+		respondErr(c, err)
 		return
 	}
-
-	// fanout via hub (includes sender username in payload)
-	s.Hub.BroadcastMessage(req.ConversationID, uid, mid, req.Content)
-
-	httpx.OK(c, gin.H{"message_id": mid})
+	httpx.OK(c, res.json(req.ClientMessageID))
 }
 
+// list returns one page of a conversation, newest first. next_cursor pages
+// towards older messages (pass it as before), prev_cursor towards newer ones
+// (pass it as after); either is null when there is nothing more that way.
 func (s Service) list(c *gin.Context) {
 	uid := auth.MustUserID(c)
-	cid := c.Param("id")
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
 	var q pageReq
-	_ = c.BindQuery(&q)
-	if q.Limit <= 0 {
-		q.Limit = 50
+	if err := c.ShouldBindQuery(&q); err != nil {
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return
 	}
+	limit := q.limit()
 
-	rows, err := s.DB.Query(`
-		SELECT
-			m.id,
-			m.sender_id,
-			u.username,
-			m.content,
-			m.sent_at,
-			CASE
-				WHEN m.sender_id = $1 THEN
-					CASE WHEN EXISTS(
-						SELECT 1 FROM participants p
-						LEFT JOIN message_status ms ON ms.message_id = m.id AND ms.user_id = p.user_id
-						WHERE p.conversation_id = m.conversation_id AND p.user_id != $1 AND ms.status != 'read'
-					) THEN 'sent'
-					ELSE 'read'
-					END
-				ELSE
-					COALESCE(ms_receiver.status, 'delivered')
-			END AS status
-		FROM messages m
-		JOIN users u ON m.sender_id = u.id
-		LEFT JOIN message_status ms_receiver ON ms_receiver.message_id = m.id AND ms_receiver.user_id = $1
-		WHERE m.conversation_id = $2
-		ORDER BY m.sent_at DESC
-		LIMIT $3 OFFSET $4
-	`, uid, cid, q.Limit, q.Offset)
-	if err != nil {
-		httpx.Err(c, 500, "db error")
+	var n int
+	_ = s.DB.QueryRow(`SELECT COUNT(1) FROM participants WHERE conversation_id=$1 AND user_id=$2`, cid, uid).Scan(&n)
+	if n == 0 {
+		httpx.Err(c, http.StatusForbidden, "not a participant")
 		return
 	}
-	defer rows.Close()
 
-	var list []gin.H
-	for rows.Next() {
-		var id, sid int64
-		var uname, content, status string
-		var at sql.NullTime
-
-		if err := rows.Scan(&id, &sid, &uname, &content, &at, &status); err != nil {
-			fmt.Printf("list: failed to scan row: %v\n", err)
-			continue
+	var p page
+	var older, newer bool // more messages exist beyond either end
+	switch {
+	case q.Around != 0:
+		var anchor cursor
+		err := s.DB.QueryRow(`SELECT sent_at, id FROM messages WHERE id=$1 AND conversation_id=$2`, q.Around, cid).Scan(&anchor.SentAt, &anchor.ID)
+		if err != nil {
+			httpx.Err(c, http.StatusNotFound, "message not found")
+			return
 		}
-
-		var sentAt string
-		if at.Valid {
-			sentAt = at.Time.Format(time.RFC3339)
+		half := limit / 2
+		before, err := s.fetch(uid, `
+			AND m.conversation_id = $2 AND (m.sent_at, m.id) <= ($3, $4)
+			ORDER BY m.sent_at DESC, m.id DESC LIMIT $5`, cid, anchor.SentAt, anchor.ID, limit-half+1)
+		if err != nil {
+			httpx.Err(c, 500, "db error")
+			return
 		}
+		after, err := s.fetch(uid, `
+			AND m.conversation_id = $2 AND (m.sent_at, m.id) > ($3, $4)
+			ORDER BY m.sent_at ASC, m.id ASC LIMIT $5`, cid, anchor.SentAt, anchor.ID, half+1)
+		if err != nil {
+			httpx.Err(c, 500, "db error")
+			return
+		}
+		older = before.truncate(limit - half)
+		newer = after.truncate(half)
+		after.reverse()
+		p = page{
+			items: append(after.items, before.items...),
+			ids:   append(after.ids, before.ids...),
+			keys:  append(after.keys, before.keys...),
+		}
+	case q.After != "":
+		cur, err := parseCursor(q.After)
+		if err != nil {
+			httpx.Err(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		p, err = s.fetch(uid, `
+			AND m.conversation_id = $2 AND (m.sent_at, m.id) > ($3, $4)
+			ORDER BY m.sent_at ASC, m.id ASC LIMIT $5`, cid, cur.SentAt, cur.ID, limit+1)
+		if err != nil {
+			httpx.Err(c, 500, "db error")
+			return
+		}
+		newer = p.truncate(limit)
+		older = true
+		p.reverse()
+	case q.Before != "":
+		cur, err := parseCursor(q.Before)
+		if err != nil {
+			httpx.Err(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		p, err = s.fetch(uid, `
+			AND m.conversation_id = $2 AND (m.sent_at, m.id) < ($3, $4)
+			ORDER BY m.sent_at DESC, m.id DESC LIMIT $5`, cid, cur.SentAt, cur.ID, limit+1)
+		if err != nil {
+			httpx.Err(c, 500, "db error")
+			return
+		}
+		older = p.truncate(limit)
+		newer = true
+	default:
+		p, err = s.fetch(uid, `
+			AND m.conversation_id = $2
+			ORDER BY m.sent_at DESC, m.id DESC LIMIT $3`, cid, limit+1)
+		if err != nil {
+			httpx.Err(c, 500, "db error")
+			return
+		}
+		older = p.truncate(limit)
+	}
 
-		list = append(list, gin.H{
-			"id": id, "sender_id": sid, "sender_username": uname,
-			"content": content, "sent_at": sentAt, "status": status,
-		})
+	s.decorate(uid, p.items, p.ids)
+	var next, prev *cursor
+	if older {
+		next = p.last()
+	}
+	if newer {
+		prev = p.first()
 	}
-	httpx.OK(c, gin.H{"messages": list})
+	httpx.OK(c, gin.H{"messages": p.items, "next_cursor": token(next), "prev_cursor": token(prev)})
 }
 
 func (s Service) markRead(c *gin.Context) {
@@ -165,77 +236,10 @@ func (s Service) markRead(c *gin.Context) {
 		return
 	}
 
-	// Begin a transaction to ensure atomicity
-	tx, err := s.DB.Begin()
-	if err != nil {
-		httpx.Err(c, http.StatusInternalServerError, "Failed to start transaction")
+	if err := s.markMessagesRead(uid, req.MessageIDs); err != nil {
+		respondErr(c, err)
 		return
 	}
-	defer tx.Rollback()
-
-	for _, messageID := range req.MessageIDs {
-		var conversationID int64
-		var senderID int64
-		var isGroupChat bool
-
-		// Change 1: Check if the current user is a participant and get conversation details.
-		// We get `conversation_id`, `sender_id`, and `is_group_chat` in a single query.
-		err := tx.QueryRow(`
-			SELECT m.conversation_id, m.sender_id, c.is_group_chat
-			FROM messages m
-			JOIN conversations c ON c.id = m.conversation_id
-			JOIN participants p ON p.conversation_id = m.conversation_id
-			WHERE m.id = $1 AND p.user_id = $2
-		`, messageID, uid).Scan(&conversationID, &senderID, &isGroupChat)
-
-		if err != nil {
-			fmt.Printf("Failed to validate message %d or user %d is not a participant: %v\n", messageID, uid, err)
-			continue
-		}
-
-		// Update or Insert the message status for the current user.
-		_, err = tx.Exec(`
-			INSERT INTO message_status (message_id, user_id, status, read_at)
-			VALUES ($1, $2, 'read', NOW())
-			ON CONFLICT(message_id, user_id) DO UPDATE SET status='read', read_at=NOW()
-		`, messageID, uid)
-		if err != nil {
-			fmt.Printf("Failed to mark message %d as read for user %d: %v\n", messageID, uid, err)
-			continue
-		}
-
-		// Change 2: Check if this is a group chat.
-		if isGroupChat {
-			// Get the count of participants who have read this message
-			var readCount int64
-			err = tx.QueryRow(`SELECT COUNT(1) FROM message_status WHERE message_id = $1 AND status = 'read'`, messageID).Scan(&readCount)
-			if err != nil {
-				fmt.Printf("Failed to get read count for message %d: %v\n", messageID, err)
-				continue
-			}
-
-			// Get the count of participants in the conversation, excluding the sender
-			var totalParticipants int64
-			err := tx.QueryRow(`SELECT COUNT(1) FROM participants WHERE conversation_id = $1 AND user_id != $2`, conversationID, senderID).Scan(&totalParticipants)
-			if err != nil {
-				fmt.Printf("Failed to get total participants for group %d: %v\n", conversationID, err)
-				continue
-			}
-
-			// Change 3: Broadcast a read receipt ONLY if all other participants have read the message.
-			if readCount == totalParticipants {
-				s.Hub.BroadcastReadReceipt(messageID, uid)
-			}
-		} else { // For a private chat, always notify the sender.
-			s.Hub.BroadcastReadReceipt(messageID, uid)
-		}
-	}
-
-	if err := tx.Commit(); err != nil {
-		httpx.Err(c, http.StatusInternalServerError, "Failed to commit transaction")
-		return
-	}
-
 	httpx.OK(c, gin.H{"message": "marked as read"})
 }
 
@@ -256,22 +260,154 @@ func (s Service) edit(c *gin.Context) {
 		httpx.Err(c, http.StatusBadRequest, err.Error())
 		return
 	}
-	var senderId int64
-	var conversationId int64
-	err = s.DB.QueryRow(`SELECT sender_id, conversation_id FROM messages WHERE id=$1`, mid).Scan(&senderId, &conversationId)
+
+	editedAt, err := s.editMessage(uid, mid, req.Content)
+	if err != nil {
+		respondErr(c, err)
+		return
+	}
+	httpx.OK(c, gin.H{"success": true, "message_id": mid, "content": req.Content, "edited_at": editedAt.UTC().Format(time.RFC3339)})
+}
+
+// history returns every earlier version of a message, oldest first, to
+// participants of its conversation.
+func (s Service) history(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	mid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid message id")
+		return
+	}
+
+	var content string
+	var sentAt time.Time
+	var editedAt sql.NullTime
+	var isDeleted bool
+	err = s.DB.QueryRow(`
+		SELECT m.content, m.sent_at, m.edited_at, m.is_deleted
+		FROM messages m
+		JOIN participants p ON p.conversation_id = m.conversation_id AND p.user_id = $2
+		WHERE m.id = $1`, mid, uid).Scan(&content, &sentAt, &editedAt, &isDeleted)
 	if err != nil {
 		httpx.Err(c, http.StatusNotFound, "message not found")
 		return
 	}
-	if senderId != uid {
-		httpx.Err(c, http.StatusForbidden, "You can only edit your own messages")
+	if isDeleted {
+		httpx.Err(c, http.StatusConflict, "message has been deleted")
 		return
 	}
-	_, err = s.DB.Exec(`UPDATE messages SET content=$1, edited_at=NOW() WHERE id=$2`, req.Content, mid)
+
+	rows, err := s.DB.Query(`SELECT content, written_at, replaced_at FROM message_revisions WHERE message_id=$1 ORDER BY replaced_at ASC, id ASC`, mid)
 	if err != nil {
-		httpx.Err(c, http.StatusInternalServerError, "failed to update message")
+		httpx.Err(c, http.StatusInternalServerError, "db error")
 		return
 	}
-	s.Hub.BroadcastEditedMessage(conversationId, mid, req.Content)
-	httpx.OK(c, gin.H{"success": true, "message_id": mid})
+	defer rows.Close()
+
+	revisions := []gin.H{}
+	for rows.Next() {
+		var old string
+		var writtenAt, replacedAt time.Time
+		if err := rows.Scan(&old, &writtenAt, &replacedAt); err != nil {
+			fmt.Printf("history: failed to scan row: %v\n", err)
+			continue
+		}
+		revisions = append(revisions, gin.H{
+			"content":     old,
+			"written_at":  writtenAt.UTC().Format(time.RFC3339),
+			"replaced_at": replacedAt.UTC().Format(time.RFC3339),
+		})
+	}
+
+	current := gin.H{"content": content, "sent_at": sentAt.UTC().Format(time.RFC3339), "edited_at": nil}
+	if editedAt.Valid {
+		current["edited_at"] = editedAt.Time.UTC().Format(time.RFC3339)
+	}
+	httpx.OK(c, gin.H{"success": true, "message_id": mid, "current": current, "revisions": revisions})
+}
+
+// delete removes a message either for the caller only ("me", the default) or
+// for every participant ("everyone"). The latter is open to the sender within
+// DeleteWindow and, at any time, to members holding delete_messages who
+// outrank the sender.
+func (s Service) delete(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	mid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid message id")
+		return
+	}
+	scope := c.DefaultQuery("scope", "me")
+
+	var senderID, conversationID int64
+	var sentAt time.Time
+	var isDeleted bool
+	err = s.DB.QueryRow(`
+		SELECT m.sender_id, m.conversation_id, m.sent_at, m.is_deleted
+		FROM messages m
+		JOIN participants p ON p.conversation_id = m.conversation_id AND p.user_id = $2
+		WHERE m.id = $1`, mid, uid).Scan(&senderID, &conversationID, &sentAt, &isDeleted)
+	if err != nil {
+		httpx.Err(c, http.StatusNotFound, "message not found")
+		return
+	}
+
+	switch scope {
+	case "me":
+		_, err = s.DB.Exec(`INSERT INTO message_hidden (message_id, user_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`, mid, uid)
+		if err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "failed to delete message")
+			return
+		}
+	case "everyone":
+		if senderID != uid {
+			if !s.canModerate(conversationID, uid, senderID) {
+				httpx.Err(c, http.StatusForbidden, "You can only delete your own messages for everyone")
+				return
+			}
+		} else if !isDeleted && s.DeleteWindow > 0 && time.Since(sentAt) > s.DeleteWindow {
+			httpx.Err(c, http.StatusForbidden, "delete window has expired")
+			return
+		}
+		if isDeleted {
+			break
+		}
+		// Keep the row as a tombstone so replies and receipts stay consistent,
+		// but drop earlier revisions along with the content.
+		_, err = s.DB.Exec(`UPDATE messages SET is_deleted=TRUE, content='' WHERE id=$1`, mid)
+		if err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "failed to delete message")
+			return
+		}
+		if _, err := s.DB.Exec(`DELETE FROM message_revisions WHERE message_id=$1`, mid); err != nil {
+			fmt.Printf("delete: failed to purge revisions of %d: %v\n", mid, err)
+		}
+		if _, err := s.DB.Exec(`DELETE FROM message_pins WHERE message_id=$1`, mid); err != nil {
+			fmt.Printf("delete: failed to unpin %d: %v\n", mid, err)
+		}
+		s.Hub.BroadcastDeletedMessage(conversationID, mid)
+		if senderID != uid {
+			var username string
+			_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, uid).Scan(&username)
+			s.Hub.BroadcastSystemMessage(conversationID, fmt.Sprintf("%s removed a message.", username))
+		}
+	default:
+		httpx.Err(c, http.StatusBadRequest, "scope must be 'me' or 'everyone'")
+		return
+	}
+	httpx.OK(c, gin.H{"success": true, "message_id": mid, "scope": scope})
+}
+
+// canModerate reports whether uid may delete senderID's messages in a
+// conversation. Senders who have since left can always be moderated.
+func (s Service) canModerate(conversationID, uid, senderID int64) bool {
+	m, err := roles.Load(s.DB, conversationID, uid)
+	if err != nil || !m.Can(roles.DeleteMessages) {
+		return false
+	}
+	senderRole, err := roles.Of(s.DB, conversationID, senderID)
+	if err == roles.ErrNotMember {
+		return true
+	}
+	return err == nil && m.Role.Outranks(senderRole)
 }
@@ -0,0 +1,140 @@
+package messages
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/roles"
+	"github.com/gin-gonic/gin"
+)
+
+func (s Service) pin(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	mid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid message id")
+		return
+	}
+	conversationID, ok := s.pinnableMessage(c, mid, uid)
+	if !ok {
+		return
+	}
+
+	res, err := s.DB.Exec(`INSERT INTO message_pins (message_id, conversation_id, pinned_by) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, mid, conversationID, uid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "failed to pin message")
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		var username string
+		_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, uid).Scan(&username)
+		s.Hub.BroadcastSystemMessage(conversationID, fmt.Sprintf("%s pinned a message.", username))
+		s.Hub.BroadcastConversationUpdate(conversationID, "message_pinned")
+	}
+	httpx.OK(c, gin.H{"success": true, "message_id": mid, "pinned": true})
+}
+
+func (s Service) unpin(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	mid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid message id")
+		return
+	}
+	conversationID, ok := s.pinnableMessage(c, mid, uid)
+	if !ok {
+		return
+	}
+
+	res, err := s.DB.Exec(`DELETE FROM message_pins WHERE message_id=$1`, mid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "failed to unpin message")
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		var username string
+		_ = s.DB.QueryRow(`SELECT username FROM users WHERE id=$1`, uid).Scan(&username)
+		s.Hub.BroadcastSystemMessage(conversationID, fmt.Sprintf("%s unpinned a message.", username))
+		s.Hub.BroadcastConversationUpdate(conversationID, "message_unpinned")
+	}
+	httpx.OK(c, gin.H{"success": true, "message_id": mid, "pinned": false})
+}
+
+// pinnableMessage returns the conversation of a message the user may pin or
+// unpin, writing the error response itself when the check fails.
+func (s Service) pinnableMessage(c *gin.Context, mid, uid int64) (int64, bool) {
+	conversationID, ok := s.reactableMessage(c, mid, uid)
+	if !ok {
+		return 0, false
+	}
+	m, err := roles.Load(s.DB, conversationID, uid)
+	if err != nil {
+		httpx.Err(c, http.StatusNotFound, "message not found")
+		return 0, false
+	}
+	if !m.Can(roles.Pin) {
+		httpx.Err(c, http.StatusForbidden, "your role does not allow pin")
+		return 0, false
+	}
+	return conversationID, true
+}
+
+// pins lists a conversation's pinned messages, most recently pinned first.
+func (s Service) pins(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	cid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid conversation id")
+		return
+	}
+	if _, err := roles.Of(s.DB, cid, uid); err != nil {
+		httpx.Err(c, http.StatusForbidden, "not a participant")
+		return
+	}
+
+	pinned, err := s.fetch(uid, `
+		AND m.conversation_id = $2
+		AND m.id IN (SELECT message_id FROM message_pins WHERE conversation_id = $2)
+		ORDER BY (SELECT pinned_at FROM message_pins mp WHERE mp.message_id = m.id) DESC
+	`, cid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "db error")
+		return
+	}
+	s.decorate(uid, pinned.items, pinned.ids)
+
+	rows, err := s.DB.Query(`SELECT message_id, pinned_by, pinned_at FROM message_pins WHERE conversation_id=$1`, cid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "db error")
+		return
+	}
+	defer rows.Close()
+	type pinInfo struct {
+		by int64
+		at time.Time
+	}
+	info := make(map[int64]pinInfo)
+	for rows.Next() {
+		var mid int64
+		var p pinInfo
+		if err := rows.Scan(&mid, &p.by, &p.at); err != nil {
+			fmt.Printf("pins: failed to scan row: %v\n", err)
+			continue
+		}
+		info[mid] = p
+	}
+	for i, m := range pinned.items {
+		p := info[pinned.ids[i]]
+		m["pinned_by"] = p.by
+		m["pinned_at"] = p.at.UTC().Format(time.RFC3339)
+	}
+
+	if pinned.items == nil {
+		pinned.items = []gin.H{}
+	}
+	httpx.OK(c, gin.H{"success": true, "pins": pinned.items})
+}
@@ -0,0 +1,200 @@
+package messages
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/attachments"
+	"github.com/ageniuscoder/mmchat/backend/internal/chat"
+	"github.com/gin-gonic/gin"
+)
+
+// replySnippetRunes is how much of a parent message is echoed on replies.
+const replySnippetRunes = 100
+
+// selectMessages is the column list and joins shared by every endpoint that
+// returns messages. $1 must be the viewing user's id; callers append further
+// conditions with AND.
+const selectMessages = `
+		SELECT
+			m.id,
+			m.sender_id,
+			u.username,
+			CASE WHEN m.is_deleted THEN '' ELSE m.content END AS content,
+			m.sent_at,
+			m.is_deleted,
+			CASE
+				WHEN m.sender_id = $1 THEN
+					CASE WHEN EXISTS(
+						SELECT 1 FROM participants p
+						LEFT JOIN message_status ms ON ms.message_id = m.id AND ms.user_id = p.user_id
+						WHERE p.conversation_id = m.conversation_id AND p.user_id != $1 AND ms.status != 'read'
+					) THEN 'sent'
+					ELSE 'read'
+					END
+				ELSE
+					COALESCE(ms_receiver.status, 'delivered')
+			END AS status,
+			m.reply_to_message_id,
+			parent.sender_id,
+			pu.username,
+			CASE WHEN parent.is_deleted THEN '' ELSE parent.content END,
+			parent.is_deleted,
+			m.edited_at,
+			(SELECT COUNT(1) FROM message_revisions rv WHERE rv.message_id = m.id) AS revision_count
+		FROM messages m
+		JOIN users u ON m.sender_id = u.id
+		LEFT JOIN message_status ms_receiver ON ms_receiver.message_id = m.id AND ms_receiver.user_id = $1
+		LEFT JOIN messages parent ON parent.id = m.reply_to_message_id
+		LEFT JOIN users pu ON pu.id = parent.sender_id
+		WHERE NOT EXISTS(SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)`
+
+// page is a run of messages as returned to clients, with their ids and
+// keyset cursors kept index-aligned.
+type page struct {
+	items []gin.H
+	ids   []int64
+	keys  []cursor
+}
+
+// truncate keeps the first n messages and reports whether any were dropped.
+func (p *page) truncate(n int) bool {
+	if len(p.items) <= n {
+		return false
+	}
+	p.items, p.ids, p.keys = p.items[:n], p.ids[:n], p.keys[:n]
+	return true
+}
+
+// reverse flips a page fetched in ascending order back to newest-first.
+func (p *page) reverse() {
+	for i, j := 0, len(p.items)-1; i < j; i, j = i+1, j-1 {
+		p.items[i], p.items[j] = p.items[j], p.items[i]
+		p.ids[i], p.ids[j] = p.ids[j], p.ids[i]
+		p.keys[i], p.keys[j] = p.keys[j], p.keys[i]
+	}
+}
+
+// first and last return the cursors at either end, or nil for an empty page.
+func (p *page) first() *cursor {
+	if len(p.keys) == 0 {
+		return nil
+	}
+	return &p.keys[0]
+}
+
+func (p *page) last() *cursor {
+	if len(p.keys) == 0 {
+		return nil
+	}
+	return &p.keys[len(p.keys)-1]
+}
+
+// scanMessages converts rows produced by selectMessages into response
+// objects.
+func scanMessages(rows *sql.Rows) page {
+	var p page
+	for rows.Next() {
+		var id, sid int64
+		var uname, content, status string
+		var at sql.NullTime
+		var isDeleted bool
+		var replyTo, parentSender sql.NullInt64
+		var parentUname, parentContent sql.NullString
+		var parentDeleted sql.NullBool
+		var editedAt sql.NullTime
+		var revisionCount int64
+
+		if err := rows.Scan(&id, &sid, &uname, &content, &at, &isDeleted, &status,
+			&replyTo, &parentSender, &parentUname, &parentContent, &parentDeleted,
+			&editedAt, &revisionCount); err != nil {
+			fmt.Printf("list: failed to scan row: %v\n", err)
+			continue
+		}
+
+		var sentAt string
+		if at.Valid {
+			sentAt = at.Time.Format(time.RFC3339)
+		}
+
+		msg := gin.H{
+			"id": id, "sender_id": sid, "sender_username": uname,
+			"content": content, "sent_at": sentAt, "status": status,
+			"is_deleted": isDeleted, "edited": editedAt.Valid,
+			"edited_at": nil, "revision_count": revisionCount,
+		}
+		if editedAt.Valid {
+			msg["edited_at"] = editedAt.Time.UTC().Format(time.RFC3339)
+		}
+		if replyTo.Valid {
+			msg["reply_to"] = gin.H{
+				"id":              replyTo.Int64,
+				"sender_id":       parentSender.Int64,
+				"sender_username": parentUname.String,
+				"content":         snippet(parentContent.String, replySnippetRunes),
+				"is_deleted":      parentDeleted.Bool,
+			}
+		}
+		p.items = append(p.items, msg)
+		p.ids = append(p.ids, id)
+		p.keys = append(p.keys, cursor{SentAt: at.Time, ID: id})
+	}
+	return p
+}
+
+// fetch runs selectMessages with extra conditions appended. uid is bound to
+// $1, so extra numbers its own parameters from $2.
+func (s Service) fetch(uid int64, extra string, args ...any) (page, error) {
+	rows, err := s.DB.Query(selectMessages+extra, append([]any{uid}, args...)...)
+	if err != nil {
+		return page{}, err
+	}
+	defer rows.Close()
+	p := scanMessages(rows)
+	return p, rows.Err()
+}
+
+// decorate attaches per-message aggregates (reactions, attachments) to a
+// scanned list.
+func (s Service) decorate(uid int64, list []gin.H, ids []int64) {
+	reactions, err := s.reactionSummaries(uid, ids)
+	if err != nil {
+		fmt.Printf("list: failed to load reactions: %v\n", err)
+	}
+	files, err := attachments.ForMessages(s.DB, ids)
+	if err != nil {
+		fmt.Printf("list: failed to load attachments: %v\n", err)
+	}
+	for i, m := range list {
+		if r, ok := reactions[ids[i]]; ok {
+			m["reactions"] = r
+		} else {
+			m["reactions"] = []gin.H{}
+		}
+		if f, ok := files[ids[i]]; ok && m["is_deleted"] != true {
+			m["attachments"] = f
+		} else {
+			m["attachments"] = []chat.Attachment{}
+		}
+	}
+}
+
+// snippet shortens s to at most n runes, marking the cut with an ellipsis.
+func snippet(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	return string(r[:n]) + "…"
+}
+
+// placeholders returns "$start,$start+1,..." for n positional arguments.
+func placeholders(start, n int) string {
+	ph := make([]string, n)
+	for i := range ph {
+		ph[i] = fmt.Sprintf("$%d", start+i)
+	}
+	return strings.Join(ph, ",")
+}
@@ -0,0 +1,148 @@
+package messages
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+// maxEmojiRunes is generous enough for skin-tone and ZWJ sequences.
+const maxEmojiRunes = 16
+
+type reactReq struct {
+	Emoji string `json:"emoji" binding:"required"`
+}
+
+func (s Service) addReaction(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	mid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid message id")
+		return
+	}
+	var req reactReq
+	if err := c.ShouldBindJSON(&req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok {
+			httpx.Err(c, http.StatusBadRequest, utils.ValidationErr(validationErrors))
+			return
+		}
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	emoji := strings.TrimSpace(req.Emoji)
+	if !validEmoji(emoji) {
+		httpx.Err(c, http.StatusBadRequest, "invalid emoji")
+		return
+	}
+
+	conversationID, ok := s.reactableMessage(c, mid, uid)
+	if !ok {
+		return
+	}
+
+	res, err := s.DB.Exec(`INSERT INTO message_reactions (message_id, user_id, emoji) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`, mid, uid, emoji)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "failed to add reaction")
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.Hub.BroadcastReaction(conversationID, mid, uid, emoji, "added")
+	}
+	httpx.OK(c, gin.H{"success": true, "message_id": mid, "emoji": emoji})
+}
+
+func (s Service) removeReaction(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	mid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid message id")
+		return
+	}
+	emoji := strings.TrimSpace(c.Query("emoji"))
+	if !validEmoji(emoji) {
+		httpx.Err(c, http.StatusBadRequest, "invalid emoji")
+		return
+	}
+
+	conversationID, ok := s.reactableMessage(c, mid, uid)
+	if !ok {
+		return
+	}
+
+	res, err := s.DB.Exec(`DELETE FROM message_reactions WHERE message_id=$1 AND user_id=$2 AND emoji=$3`, mid, uid, emoji)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "failed to remove reaction")
+		return
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		s.Hub.BroadcastReaction(conversationID, mid, uid, emoji, "removed")
+	}
+	httpx.OK(c, gin.H{"success": true, "message_id": mid, "emoji": emoji})
+}
+
+// reactableMessage returns the conversation of a message the user may react
+// to, writing the error response itself when the lookup fails.
+func (s Service) reactableMessage(c *gin.Context, mid, uid int64) (int64, bool) {
+	var conversationID int64
+	var isDeleted bool
+	err := s.DB.QueryRow(`
+		SELECT m.conversation_id, m.is_deleted
+		FROM messages m
+		JOIN participants p ON p.conversation_id = m.conversation_id AND p.user_id = $2
+		WHERE m.id = $1`, mid, uid).Scan(&conversationID, &isDeleted)
+	if err != nil {
+		httpx.Err(c, http.StatusNotFound, "message not found")
+		return 0, false
+	}
+	if isDeleted {
+		httpx.Err(c, http.StatusConflict, "message has been deleted")
+		return 0, false
+	}
+	return conversationID, true
+}
+
+// reactionSummaries aggregates reactions per emoji for each of the given
+// messages, flagging the ones the user has reacted with.
+func (s Service) reactionSummaries(uid int64, ids []int64) (map[int64][]gin.H, error) {
+	out := make(map[int64][]gin.H)
+	if len(ids) == 0 {
+		return out, nil
+	}
+	args := []any{uid}
+	for _, id := range ids {
+		args = append(args, id)
+	}
+	rows, err := s.DB.Query(`
+		SELECT message_id, emoji, COUNT(1), MAX(CASE WHEN user_id = $1 THEN 1 ELSE 0 END)
+		FROM message_reactions
+		WHERE message_id IN (`+placeholders(2, len(ids))+`)
+		GROUP BY message_id, emoji
+		ORDER BY MIN(created_at)`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var mid, count int64
+		var emoji string
+		var mine int
+		if err := rows.Scan(&mid, &emoji, &count, &mine); err != nil {
+			return nil, err
+		}
+		out[mid] = append(out[mid], gin.H{"emoji": emoji, "count": count, "reacted": mine == 1})
+	}
+	return out, rows.Err()
+}
+
+func validEmoji(e string) bool {
+	n := utf8.RuneCountInString(e)
+	return n > 0 && n <= maxEmojiRunes && !strings.ContainsAny(e, " \t\n")
+}
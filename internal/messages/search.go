@@ -0,0 +1,221 @@
+package messages
+
+import (
+	"database/sql"
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+const (
+	minSearchRunes = 2
+	// snippetContext is how many runes around a LIKE match the fallback keeps.
+	snippetContext = 40
+	// markStart/markStop delimit matches until the snippet is HTML-escaped.
+	markStart = "\x01"
+	markStop  = "\x02"
+)
+
+type searchReq struct {
+	Q              string `form:"q"`
+	ConversationID int64  `form:"conversation_id"`
+	SenderID       int64  `form:"sender_id"`
+	From           string `form:"from"` // RFC3339 or YYYY-MM-DD, inclusive
+	To             string `form:"to"`   // RFC3339 or YYYY-MM-DD, exclusive
+	Before         string `form:"before"`
+	Limit          int    `form:"limit"`
+}
+
+// usesFullText reports whether db can run the tsvector query; other backends
+// (SQLite) fall back to LIKE.
+func usesFullText(db *sql.DB) bool {
+	_, ok := db.Driver().(*pq.Driver)
+	return ok
+}
+
+// search finds messages containing q across every conversation the caller
+// participates in, newest first. Snippets are HTML-escaped with matches
+// wrapped in <mark>.
+func (s Service) search(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	var req searchReq
+	if err := c.ShouldBindQuery(&req); err != nil {
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	req.Q = strings.TrimSpace(req.Q)
+	if utf8.RuneCountInString(req.Q) < minSearchRunes {
+		httpx.Err(c, http.StatusBadRequest, fmt.Sprintf("query must be at least %d characters", minSearchRunes))
+		return
+	}
+	limit := pageReq{Limit: req.Limit}.limit()
+
+	args := []any{uid}
+	arg := func(v any) string {
+		args = append(args, v)
+		return fmt.Sprintf("$%d", len(args))
+	}
+
+	var match, headline string
+	if s.FullText {
+		q := arg(req.Q)
+		match = `AND m.content_tsv @@ plainto_tsquery('simple', ` + q + `)`
+		opts := arg("StartSel=" + markStart + ", StopSel=" + markStop + ", MaxFragments=2, MaxWords=20, MinWords=5")
+		// drop the delimiters from the content so a message cannot forge marks
+		content := `translate(m.content, ` + arg(markStart+markStop) + `, '')`
+		headline = `ts_headline('simple', ` + content + `, plainto_tsquery('simple', ` + q + `), ` + opts + `)`
+	} else {
+		match = `AND LOWER(m.content) LIKE ` + arg("%"+escapeLike(strings.ToLower(req.Q))+"%") + ` ESCAPE '\'`
+		headline = `m.content`
+	}
+
+	var where strings.Builder
+	where.WriteString(match)
+	if req.ConversationID != 0 {
+		where.WriteString(` AND m.conversation_id = ` + arg(req.ConversationID))
+	}
+	if req.SenderID != 0 {
+		where.WriteString(` AND m.sender_id = ` + arg(req.SenderID))
+	}
+	for _, bound := range []struct{ val, op string }{{req.From, ">="}, {req.To, "<"}} {
+		if bound.val == "" {
+			continue
+		}
+		t, err := parseDate(bound.val)
+		if err != nil {
+			httpx.Err(c, http.StatusBadRequest, "from/to must be RFC3339 or YYYY-MM-DD")
+			return
+		}
+		where.WriteString(` AND m.sent_at ` + bound.op + ` ` + arg(t))
+	}
+	if req.Before != "" {
+		cur, err := parseCursor(req.Before)
+		if err != nil {
+			httpx.Err(c, http.StatusBadRequest, err.Error())
+			return
+		}
+		where.WriteString(` AND (m.sent_at, m.id) < (` + arg(cur.SentAt) + `, ` + arg(cur.ID) + `)`)
+	}
+
+	rows, err := s.DB.Query(`
+		SELECT m.id, m.conversation_id, COALESCE(c.name, ''), c.is_group_chat,
+			m.sender_id, u.username, m.sent_at, `+headline+`
+		FROM messages m
+		JOIN participants p ON p.conversation_id = m.conversation_id AND p.user_id = $1
+		JOIN conversations c ON c.id = m.conversation_id
+		JOIN users u ON u.id = m.sender_id
+		WHERE m.is_deleted = FALSE
+		AND NOT EXISTS(SELECT 1 FROM message_hidden h WHERE h.message_id = m.id AND h.user_id = $1)
+		`+where.String()+`
+		ORDER BY m.sent_at DESC, m.id DESC
+		LIMIT `+arg(limit+1), args...)
+	if err != nil {
+		fmt.Printf("search: query failed: %v\n", err)
+		httpx.Err(c, http.StatusInternalServerError, "search failed")
+		return
+	}
+	defer rows.Close()
+
+	var results []gin.H
+	var last cursor
+	more := false
+	for rows.Next() {
+		if len(results) == limit {
+			more = true
+			break
+		}
+		var id, convID, senderID int64
+		var convName, sender, text string
+		var isGroup bool
+		var at time.Time
+		if err := rows.Scan(&id, &convID, &convName, &isGroup, &senderID, &sender, &at, &text); err != nil {
+			fmt.Printf("search: failed to scan row: %v\n", err)
+			continue
+		}
+		if !s.FullText {
+			text = markMatch(stripMarks(text), req.Q)
+		}
+		results = append(results, gin.H{
+			"message_id":        id,
+			"conversation_id":   convID,
+			"conversation_name": convName,
+			"is_group":          isGroup,
+			"sender_id":         senderID,
+			"sender_username":   sender,
+			"sent_at":           at.UTC().Format(time.RFC3339),
+			"snippet":           renderSnippet(text),
+		})
+		last = cursor{SentAt: at, ID: id}
+	}
+
+	var next *cursor
+	if more {
+		next = &last
+	}
+	httpx.OK(c, gin.H{"success": true, "results": results, "next_cursor": token(next)})
+}
+
+// markMatch cuts a window around the first case-insensitive match of q in
+// text and delimits the match the way ts_headline does.
+func markMatch(text, q string) string {
+	hay := []rune(text)
+	needle := []rune(strings.ToLower(q))
+	lower := []rune(strings.ToLower(text))
+	idx := -1
+	if len(lower) == len(hay) {
+		for i := 0; i+len(needle) <= len(lower); i++ {
+			if string(lower[i:i+len(needle)]) == string(needle) {
+				idx = i
+				break
+			}
+		}
+	}
+	if idx < 0 {
+		return snippet(text, 2*snippetContext)
+	}
+	start := max(0, idx-snippetContext)
+	end := min(len(hay), idx+len(needle)+snippetContext)
+	var b strings.Builder
+	if start > 0 {
+		b.WriteString("…")
+	}
+	b.WriteString(string(hay[start:idx]))
+	b.WriteString(markStart + string(hay[idx:idx+len(needle)]) + markStop)
+	b.WriteString(string(hay[idx+len(needle) : end]))
+	if end < len(hay) {
+		b.WriteString("…")
+	}
+	return b.String()
+}
+
+// stripMarks removes the match delimiters from message text.
+func stripMarks(s string) string {
+	return strings.NewReplacer(markStart, "", markStop, "").Replace(s)
+}
+
+// renderSnippet escapes message text for HTML and turns the match delimiters
+// into <mark> tags.
+func renderSnippet(s string) string {
+	s = html.EscapeString(s)
+	s = strings.ReplaceAll(s, markStart, "<mark>")
+	return strings.ReplaceAll(s, markStop, "</mark>")
+}
+
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+func parseDate(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", s)
+}
@@ -0,0 +1,362 @@
+package messages
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/attachments"
+	"github.com/ageniuscoder/mmchat/backend/internal/chat"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/roles"
+	"github.com/gin-gonic/gin"
+)
+
+const maxClientMessageID = 64
+
+// Error is a failed message operation. Status is used for REST responses and
+// Code is the stable identifier sent in WebSocket acks.
+type Error struct {
+	Status int
+	Code   string
+	Msg    string
+	// RetryAfter is set in seconds on rate limited (429) errors.
+	RetryAfter int
+}
+
+func (e *Error) Error() string { return e.Msg }
+
+// ErrorCode lets the chat package read the code without importing this one.
+func (e *Error) ErrorCode() string { return e.Code }
+
+// RetryAfterSeconds lets the chat package read RetryAfter the same way.
+func (e *Error) RetryAfterSeconds() int { return e.RetryAfter }
+
+func newErr(status int, code, msg string) *Error {
+	return &Error{Status: status, Code: code, Msg: msg}
+}
+
+// respondErr writes an error returned by the core operations below.
+func respondErr(c *gin.Context, err error) {
+	var e *Error
+	if errors.As(err, &e) {
+		if e.RetryAfter > 0 {
+			c.Header("Retry-After", strconv.Itoa(e.RetryAfter))
+		}
+		httpx.Err(c, e.Status, e.Msg)
+		return
+	}
+	httpx.Err(c, http.StatusInternalServerError, err.Error())
+}
+
+type sendResult struct {
+	MessageID   int64
+	SentAt      time.Time
+	Attachments []chat.Attachment
+	Duplicate   bool
+}
+
+func (r sendResult) json(clientID string) gin.H {
+	return gin.H{
+		"message_id":        r.MessageID,
+		"client_message_id": clientID,
+		"sent_at":           r.SentAt.UTC().Format(time.RFC3339),
+		"attachments":       r.Attachments,
+		"duplicate":         r.Duplicate,
+	}
+}
+
+// sendMessage validates, stores and fans out a new message. It backs both
+// POST /messages and the send_message WebSocket frame.
+func (s Service) sendMessage(uid int64, req sendReq) (sendResult, error) {
+	if strings.TrimSpace(req.Content) == "" && len(req.AttachmentIDs) == 0 {
+		return sendResult{}, newErr(http.StatusBadRequest, "empty_message", "message must have content or attachments")
+	}
+	if len(req.ClientMessageID) > maxClientMessageID {
+		return sendResult{}, newErr(http.StatusBadRequest, "invalid_client_message_id", "client_message_id is too long")
+	}
+
+	// authorize participant and their role
+	m, err := roles.Load(s.DB, req.ConversationID, uid)
+	if err == roles.ErrNotMember {
+		return sendResult{}, newErr(http.StatusForbidden, "not_participant", "not a participant")
+	}
+	if err != nil {
+		return sendResult{}, newErr(http.StatusInternalServerError, "internal", "database error")
+	}
+	if m.IsGroup && m.AnnouncementOnly && !m.Can(roles.Post) {
+		return sendResult{}, newErr(http.StatusForbidden, "announcement_only", "only admins can post in this group")
+	}
+	if !m.Can(roles.Post) {
+		return sendResult{}, newErr(http.StatusForbidden, "post_not_allowed", "your role does not allow posting in this group")
+	}
+
+	// a retried send returns what was stored the first time
+	if req.ClientMessageID != "" {
+		if res, ok, err := s.replay(uid, req); ok {
+			return res, err
+		}
+	}
+
+	// a reply must point at a message of the same conversation
+	var replyTo sql.NullInt64
+	if req.ReplyToMessageID != nil {
+		var parentConv int64
+		err := s.DB.QueryRow(`SELECT conversation_id FROM messages WHERE id=$1`, *req.ReplyToMessageID).Scan(&parentConv)
+		if err != nil || parentConv != req.ConversationID {
+			return sendResult{}, newErr(http.StatusBadRequest, "invalid_reply", "reply target must be a message in the same conversation")
+		}
+		replyTo = sql.NullInt64{Int64: *req.ReplyToMessageID, Valid: true}
+	}
+	clientID := sql.NullString{String: req.ClientMessageID, Valid: req.ClientMessageID != ""}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return sendResult{}, newErr(http.StatusInternalServerError, "internal", "Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	if wait := m.SlowMode(); wait > 0 {
+		if err := slowModeCheck(tx, req.ConversationID, uid, wait); err != nil {
+			return sendResult{}, err
+		}
+	}
+
+	res := sendResult{}
+	err = tx.QueryRow(`INSERT INTO messages (conversation_id, sender_id, content, reply_to_message_id, client_message_id) VALUES ($1, $2, $3, $4, $5) RETURNING id, sent_at`,
+		req.ConversationID, uid, req.Content, replyTo, clientID).Scan(&res.MessageID, &res.SentAt)
+	if err != nil {
+		// a concurrent retry may have won the unique (sender_id, client_message_id) race
+		tx.Rollback()
+		if clientID.Valid {
+			if res, ok, err := s.replay(uid, req); ok {
+				return res, err
+			}
+		}
+		return sendResult{}, newErr(http.StatusBadRequest, "insert_failed", "insert failed")
+	}
+	mid := res.MessageID
+	if err := attachments.Claim(tx, mid, req.ConversationID, uid, req.AttachmentIDs); err != nil {
+		return sendResult{}, newErr(http.StatusBadRequest, "invalid_attachments", "invalid attachment ids")
+	}
+	if err := tx.Commit(); err != nil {
+		return sendResult{}, newErr(http.StatusInternalServerError, "internal", "Failed to commit transaction")
+	}
+
+	files, err := attachments.ForMessages(s.DB, []int64{mid})
+	if err != nil {
+		fmt.Printf("send: failed to load attachments for %d: %v\n", mid, err)
+	}
+	res.Attachments = files[mid]
+
+	// fanout via hub (includes sender username in payload); the sender's own
+	// other connections get it too so they can reconcile by client_message_id
+	s.Hub.BroadcastMessage(chat.WireMessage{
+		ConversationID:   req.ConversationID,
+		MessageID:        mid,
+		SenderID:         uid,
+		Content:          req.Content,
+		SentAt:           res.SentAt.UTC().Format(time.RFC3339),
+		ReplyToMessageID: replyTo.Int64,
+		Attachments:      res.Attachments,
+		ClientMessageID:  req.ClientMessageID,
+	})
+	return res, nil
+}
+
+// slowModeCheck fails with 429 when the user's previous message in the
+// conversation is less than wait seconds old. Locking the participant row
+// serialises concurrent sends by the same user until tx ends.
+func slowModeCheck(tx *sql.Tx, conversationID, uid int64, wait int) error {
+	if _, err := tx.Exec(`SELECT 1 FROM participants WHERE conversation_id=$1 AND user_id=$2 FOR UPDATE`, conversationID, uid); err != nil {
+		return newErr(http.StatusInternalServerError, "internal", "database error")
+	}
+	var last sql.NullTime
+	if err := tx.QueryRow(`SELECT MAX(sent_at) FROM messages WHERE conversation_id=$1 AND sender_id=$2`, conversationID, uid).Scan(&last); err != nil {
+		return newErr(http.StatusInternalServerError, "internal", "database error")
+	}
+	if !last.Valid {
+		return nil
+	}
+	remaining := time.Duration(wait)*time.Second - time.Since(last.Time)
+	if remaining <= 0 {
+		return nil
+	}
+	e := newErr(http.StatusTooManyRequests, "slow_mode", fmt.Sprintf("slow mode is on: wait %d seconds between messages", wait))
+	e.RetryAfter = int((remaining + time.Second - 1) / time.Second)
+	return e
+}
+
+// replay looks up a message the sender already stored under the request's
+// client_message_id. ok is false when there is no such message yet.
+func (s Service) replay(uid int64, req sendReq) (res sendResult, ok bool, err error) {
+	var conversationID int64
+	err = s.DB.QueryRow(`SELECT id, conversation_id, sent_at FROM messages WHERE sender_id=$1 AND client_message_id=$2`,
+		uid, req.ClientMessageID).Scan(&res.MessageID, &conversationID, &res.SentAt)
+	if err != nil {
+		return sendResult{}, false, nil
+	}
+	if conversationID != req.ConversationID {
+		return sendResult{}, true, newErr(http.StatusConflict, "client_message_id_conflict", "client_message_id already used in another conversation")
+	}
+	files, err := attachments.ForMessages(s.DB, []int64{res.MessageID})
+	if err != nil {
+		fmt.Printf("send: failed to load attachments for %d: %v\n", res.MessageID, err)
+	}
+	res.Attachments = files[res.MessageID]
+	res.Duplicate = true
+	return res, true, nil
+}
+
+// markMessagesRead records read status for every message the user can see
+// and emits read receipts. Messages the user cannot access are skipped.
+func (s Service) markMessagesRead(uid int64, messageIDs []int64) error {
+	// Begin a transaction to ensure atomicity
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return newErr(http.StatusInternalServerError, "internal", "Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	for _, messageID := range messageIDs {
+		var conversationID int64
+		var senderID int64
+		var isGroupChat bool
+
+		// Change 1: Check if the current user is a participant and get conversation details.
+		// We get `conversation_id`, `sender_id`, and `is_group_chat` in a single query.
+		err := tx.QueryRow(`
+			SELECT m.conversation_id, m.sender_id, c.is_group_chat
+			FROM messages m
+			JOIN conversations c ON c.id = m.conversation_id
+			JOIN participants p ON p.conversation_id = m.conversation_id
+			WHERE m.id = $1 AND p.user_id = $2
+		`, messageID, uid).Scan(&conversationID, &senderID, &isGroupChat)
+
+		if err != nil {
+			fmt.Printf("Failed to validate message %d or user %d is not a participant: %v\n", messageID, uid, err)
+			continue
+		}
+
+		// Update or Insert the message status for the current user.
+		_, err = tx.Exec(`
+			INSERT INTO message_status (message_id, user_id, status, read_at)
+			VALUES ($1, $2, 'read', NOW())
+			ON CONFLICT(message_id, user_id) DO UPDATE SET status='read', read_at=NOW()
+		`, messageID, uid)
+		if err != nil {
+			fmt.Printf("Failed to mark message %d as read for user %d: %v\n", messageID, uid, err)
+			continue
+		}
+
+		// Change 2: Check if this is a group chat.
+		if isGroupChat {
+			// Get the count of participants who have read this message
+			var readCount int64
+			err = tx.QueryRow(`SELECT COUNT(1) FROM message_status WHERE message_id = $1 AND status = 'read'`, messageID).Scan(&readCount)
+			if err != nil {
+				fmt.Printf("Failed to get read count for message %d: %v\n", messageID, err)
+				continue
+			}
+
+			// Get the count of participants in the conversation, excluding the sender
+			var totalParticipants int64
+			err := tx.QueryRow(`SELECT COUNT(1) FROM participants WHERE conversation_id = $1 AND user_id != $2`, conversationID, senderID).Scan(&totalParticipants)
+			if err != nil {
+				fmt.Printf("Failed to get total participants for group %d: %v\n", conversationID, err)
+				continue
+			}
+
+			// Change 3: Broadcast a read receipt ONLY if all other participants have read the message.
+			if readCount == totalParticipants {
+				s.Hub.BroadcastReadReceipt(messageID, uid)
+			}
+		} else { // For a private chat, always notify the sender.
+			s.Hub.BroadcastReadReceipt(messageID, uid)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return newErr(http.StatusInternalServerError, "internal", "Failed to commit transaction")
+	}
+	return nil
+}
+
+// editMessage replaces the content of the user's own message, keeping the
+// previous content as a revision.
+func (s Service) editMessage(uid, mid int64, content string) (time.Time, error) {
+	if strings.TrimSpace(content) == "" {
+		return time.Time{}, newErr(http.StatusBadRequest, "empty_message", "content is required")
+	}
+	var senderId int64
+	var conversationId int64
+	var isDeleted bool
+	err := s.DB.QueryRow(`SELECT sender_id, conversation_id, is_deleted FROM messages WHERE id=$1`, mid).Scan(&senderId, &conversationId, &isDeleted)
+	if err != nil {
+		return time.Time{}, newErr(http.StatusNotFound, "not_found", "message not found")
+	}
+	if senderId != uid {
+		return time.Time{}, newErr(http.StatusForbidden, "forbidden", "You can only edit your own messages")
+	}
+	if isDeleted {
+		return time.Time{}, newErr(http.StatusConflict, "deleted", "message has been deleted")
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return time.Time{}, newErr(http.StatusInternalServerError, "internal", "Failed to start transaction")
+	}
+	defer tx.Rollback()
+
+	// keep the content being replaced as a revision
+	_, err = tx.Exec(`
+		INSERT INTO message_revisions (message_id, content, written_at)
+		SELECT id, content, COALESCE(edited_at, sent_at) FROM messages WHERE id=$1`, mid)
+	if err != nil {
+		return time.Time{}, newErr(http.StatusInternalServerError, "internal", "failed to update message")
+	}
+	var editedAt time.Time
+	// a delete for everyone may have landed since the check above
+	err = tx.QueryRow(`UPDATE messages SET content=$1, edited_at=NOW() WHERE id=$2 AND is_deleted = FALSE RETURNING edited_at`, content, mid).Scan(&editedAt)
+	if err == sql.ErrNoRows {
+		return time.Time{}, newErr(http.StatusConflict, "deleted", "message has been deleted")
+	}
+	if err != nil {
+		return time.Time{}, newErr(http.StatusInternalServerError, "internal", "failed to update message")
+	}
+	if err := tx.Commit(); err != nil {
+		return time.Time{}, newErr(http.StatusInternalServerError, "internal", "Failed to commit transaction")
+	}
+	s.Hub.BroadcastEditedMessage(conversationId, mid, content, editedAt)
+	return editedAt, nil
+}
+
+// SendMessage implements chat.MessageService.
+func (s Service) SendMessage(userID int64, in chat.SendRequest) (chat.SendResult, error) {
+	res, err := s.sendMessage(userID, sendReq{
+		ConversationID:   in.ConversationID,
+		Content:          in.Content,
+		ReplyToMessageID: in.ReplyToMessageID,
+		AttachmentIDs:    in.AttachmentIDs,
+		ClientMessageID:  in.ClientMessageID,
+	})
+	if err != nil {
+		return chat.SendResult{}, err
+	}
+	return chat.SendResult{MessageID: res.MessageID, Duplicate: res.Duplicate}, nil
+}
+
+// MarkRead implements chat.MessageService.
+func (s Service) MarkRead(userID int64, messageIDs []int64) error {
+	return s.markMessagesRead(userID, messageIDs)
+}
+
+// EditMessage implements chat.MessageService.
+func (s Service) EditMessage(userID, messageID int64, content string) error {
+	_, err := s.editMessage(userID, messageID, content)
+	return err
+}
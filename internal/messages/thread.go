@@ -0,0 +1,76 @@
+package messages
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/gin-gonic/gin"
+)
+
+// thread pages through every reply (direct or nested) below a root message,
+// oldest first. next_cursor is passed back as after to load more replies.
+func (s Service) thread(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	rootID, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid message id")
+		return
+	}
+	var q pageReq
+	if err := c.ShouldBindQuery(&q); err != nil {
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	limit := q.limit()
+
+	// root must exist in a conversation the caller belongs to
+	root, err := s.fetch(uid, `
+		AND m.id = $2
+		AND EXISTS(SELECT 1 FROM participants p WHERE p.conversation_id = m.conversation_id AND p.user_id = $1)
+	`, rootID)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "db error")
+		return
+	}
+	if len(root.items) == 0 {
+		httpx.Err(c, http.StatusNotFound, "message not found")
+		return
+	}
+	s.decorate(uid, root.items, root.ids)
+
+	var after cursor // zero value sorts before every reply
+	if q.After != "" {
+		if after, err = parseCursor(q.After); err != nil {
+			httpx.Err(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	thread := `
+		WITH RECURSIVE thread(id) AS (
+			SELECT id FROM messages WHERE reply_to_message_id = $2
+			UNION
+			SELECT r.id FROM messages r JOIN thread t ON r.reply_to_message_id = t.id
+		)`
+	rows, err := s.DB.Query(thread+selectMessages+`
+		AND m.id IN (SELECT id FROM thread)
+		AND (m.sent_at, m.id) > ($3, $4)
+		ORDER BY m.sent_at ASC, m.id ASC
+		LIMIT $5
+	`, uid, rootID, after.SentAt, after.ID, limit+1)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "db error")
+		return
+	}
+	defer rows.Close()
+
+	replies := scanMessages(rows)
+	var next *cursor
+	if replies.truncate(limit) {
+		next = replies.last()
+	}
+	s.decorate(uid, replies.items, replies.ids)
+	httpx.OK(c, gin.H{"success": true, "root": root.items[0], "replies": replies.items, "next_cursor": token(next)})
+}
@@ -2,6 +2,7 @@ package otp
 
 import (
 	"crypto/rand"
+	"crypto/subtle"
 	"database/sql"
 	"fmt"
 	"math/big"
@@ -26,6 +27,9 @@ type Service struct {
 	TTL            time.Duration
 	SendGridAPIKey string
 	SendGridFrom   string // verified sender email
+	// MaxAttempts is how many wrong guesses an outstanding code survives;
+	// zero allows unlimited guesses.
+	MaxAttempts int
 }
 
 // randomDigit generates a secure random n-digit string.
@@ -50,8 +54,22 @@ func (s *Service) Genrate(email, purpose string) (string, error) {
 
 	expiresAt := time.Now().UTC().Add(s.TTL)
 
-	// Store OTP in DB
-	_, err = s.DB.Exec(
+	// Store OTP in DB, replacing any earlier code for the same purpose so
+	// only the newest one is valid and its attempts count.
+	tx, err := s.DB.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		`DELETE FROM otp_codes
+         WHERE email=$1 AND purpose=$2`,
+		email, purpose,
+	)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(
 		`INSERT INTO otp_codes (email, code, purpose, expires_at)
          VALUES ($1, $2, $3, $4)`,
 		email, code, purpose, expiresAt,
@@ -59,6 +77,9 @@ func (s *Service) Genrate(email, purpose string) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
 
 	fmt.Println("OTP code generated and stored:", code) // Debug log
 	// Send OTP via SendGrid
@@ -78,7 +99,8 @@ func (s *Service) Genrate(email, purpose string) (string, error) {
 	return code, nil
 }
 
-// Verify checks if the OTP is valid and not expired.
+// Verify checks if the OTP is valid and not expired. Wrong guesses count
+// towards MaxAttempts.
 func (s *Service) Verify(email, purpose, code string) (bool, error) {
 	// Begin a new transaction
 	tx, err := s.DB.Begin()
@@ -91,24 +113,31 @@ func (s *Service) Verify(email, purpose, code string) (bool, error) {
 	// Cleanup expired codes inside the transaction.
 	_, _ = tx.Exec(`DELETE FROM otp_codes WHERE expires_at <= NOW()`)
 
-	var n int
-	row := tx.QueryRow(
-		`SELECT COUNT(1) FROM otp_codes             
-         WHERE email=$1 AND purpose=$2 AND code=$3 
-           AND expires_at > NOW()`,
-		email, purpose, code,
-	)
-
-	if err := row.Scan(&n); err != nil {
+	// Count this guess before comparing. The update locks the row, so
+	// parallel guesses are checked one at a time and none gets past the
+	// limit.
+	var want string
+	var attempts int
+	err = tx.QueryRow(
+		`UPDATE otp_codes SET attempts = attempts + 1
+         WHERE email=$1 AND purpose=$2 AND expires_at > NOW()
+           AND ($3 = 0 OR attempts < $3)
+         RETURNING code, attempts`,
+		email, purpose, s.MaxAttempts,
+	).Scan(&want, &attempts)
+	if err == sql.ErrNoRows {
+		return false, tx.Commit()
+	}
+	if err != nil {
 		return false, err
 	}
 
-	if n == 1 {
+	if subtle.ConstantTimeCompare([]byte(want), []byte(code)) == 1 {
 		// Delete the OTP after successful verification.
 		_, err := tx.Exec(
 			`DELETE FROM otp_codes 
-             WHERE email=$1 AND purpose=$2 AND code=$3`,
-			email, purpose, code,
+             WHERE email=$1 AND purpose=$2`,
+			email, purpose,
 		)
 		if err != nil {
 			return false, err
@@ -117,5 +146,17 @@ func (s *Service) Verify(email, purpose, code string) (bool, error) {
 		return true, tx.Commit()
 	}
 
-	return false, nil
+	// Burn the code at the limit, so it cannot be brute-forced within its
+	// TTL.
+	if s.MaxAttempts > 0 && attempts >= s.MaxAttempts {
+		_, err := tx.Exec(
+			`DELETE FROM otp_codes
+             WHERE email=$1 AND purpose=$2`,
+			email, purpose,
+		)
+		if err != nil {
+			return false, err
+		}
+	}
+	return false, tx.Commit()
 }
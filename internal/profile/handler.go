@@ -8,6 +8,7 @@ import (
 	"time"
 
 	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/chat"
 	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
 	"github.com/ageniuscoder/mmchat/backend/internal/utils"
 	"github.com/gin-gonic/gin"
@@ -15,16 +16,18 @@ import (
 )
 
 type Service struct {
-	DB *sql.DB
+	DB  *sql.DB
+	Hub *chat.Hub
 }
 type UpdateReq struct {
 	Username       string `json:"username"`
 	ProfilePicture string `json:"profile_picture"`
 }
 
-func Register(rg *gin.RouterGroup, db *sql.DB) {
+func Register(rg *gin.RouterGroup, db *sql.DB, hub *chat.Hub) {
 	s := Service{
-		DB: db,
+		DB:  db,
+		Hub: hub,
 	}
 	rg.GET("/me", s.getMe)
 	rg.PUT("/me", s.updateMe)
@@ -86,5 +89,6 @@ func (s Service) updateMe(c *gin.Context) {
 	if err != nil {
 		httpx.Err(c, http.StatusInternalServerError, "Profile Update failed")
 	}
+	s.Hub.InvalidateUser(uid)
 	s.getMe(c)
 }
@@ -0,0 +1,139 @@
+package roles
+
+import (
+	"database/sql"
+	"errors"
+)
+
+// Role is a participant's standing in a group, from Owner down to ReadOnly.
+type Role string
+
+const (
+	Owner     Role = "owner"
+	Admin     Role = "admin"
+	Moderator Role = "moderator"
+	Member    Role = "member"
+	ReadOnly  Role = "read_only"
+)
+
+var rank = map[Role]int{
+	ReadOnly:  1,
+	Member:    2,
+	Moderator: 3,
+	Admin:     4,
+	Owner:     5,
+}
+
+func (r Role) Valid() bool { return rank[r] > 0 }
+
+// AtLeast reports whether r is min or higher.
+func (r Role) AtLeast(min Role) bool { return r.Valid() && rank[r] >= rank[min] }
+
+// Outranks reports whether r is strictly higher than other.
+func (r Role) Outranks(other Role) bool { return rank[r] > rank[other] }
+
+// Permission is an action whose required role each group chooses.
+type Permission string
+
+const (
+	Post           Permission = "post"
+	AddMembers     Permission = "add_members"
+	EditInfo       Permission = "edit_info"
+	Pin            Permission = "pin"
+	DeleteMessages Permission = "delete_messages"
+)
+
+// Permissions lists every permission in the order of the conversations
+// columns that store them.
+var Permissions = []Permission{Post, AddMembers, EditInfo, Pin, DeleteMessages}
+
+// Column is the conversations column holding the least role for p.
+func (p Permission) Column() string { return "perm_" + string(p) }
+
+// Set maps each permission to the least role that holds it.
+type Set map[Permission]Role
+
+// Defaults is the permission set of a new group.
+var Defaults = Set{
+	Post:           Member,
+	AddMembers:     Admin,
+	EditInfo:       Admin,
+	Pin:            Moderator,
+	DeleteMessages: Moderator,
+}
+
+var ErrNotMember = errors.New("not a member of this conversation")
+
+// Membership is what a user may do in one conversation.
+type Membership struct {
+	Role    Role
+	IsGroup bool
+	Perms   Set
+	// AnnouncementOnly restricts posting to admins and the owner on top of
+	// Perms[Post].
+	AnnouncementOnly bool
+	// SlowModeSec is the least time between two messages of one member, or 0.
+	SlowModeSec int
+}
+
+// Can reports whether the member holds p. In private conversations both
+// participants may post and nothing else.
+func (m Membership) Can(p Permission) bool {
+	if !m.IsGroup {
+		return p == Post
+	}
+	if p == Post && m.AnnouncementOnly && !m.Role.AtLeast(Admin) {
+		return false
+	}
+	return m.Role.AtLeast(m.Perms[p])
+}
+
+// SlowMode returns the wait enforced between the member's messages.
+// Moderators and above are exempt.
+func (m Membership) SlowMode() int {
+	if !m.IsGroup || m.Role.AtLeast(Moderator) {
+		return 0
+	}
+	return m.SlowModeSec
+}
+
+type querier interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// Load returns userID's membership of a conversation, or ErrNotMember.
+func Load(q querier, conversationID, userID int64) (Membership, error) {
+	var m Membership
+	var role string
+	perms := make([]string, len(Permissions))
+	dest := []any{&role, &m.IsGroup, &m.AnnouncementOnly, &m.SlowModeSec}
+	for i := range perms {
+		dest = append(dest, &perms[i])
+	}
+	err := q.QueryRow(`
+		SELECT p.role, c.is_group_chat, c.announcement_only, c.slow_mode_sec, c.perm_post, c.perm_add_members, c.perm_edit_info, c.perm_pin, c.perm_delete_messages
+		FROM participants p
+		JOIN conversations c ON c.id = p.conversation_id
+		WHERE p.conversation_id=$1 AND p.user_id=$2`, conversationID, userID).Scan(dest...)
+	if err == sql.ErrNoRows {
+		return Membership{}, ErrNotMember
+	}
+	if err != nil {
+		return Membership{}, err
+	}
+	m.Role, m.Perms = Role(role), make(Set, len(Permissions))
+	for i, p := range Permissions {
+		m.Perms[p] = Role(perms[i])
+	}
+	return m, nil
+}
+
+// Of returns userID's role in a conversation, or ErrNotMember.
+func Of(q querier, conversationID, userID int64) (Role, error) {
+	var role string
+	err := q.QueryRow(`SELECT role FROM participants WHERE conversation_id=$1 AND user_id=$2`, conversationID, userID).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotMember
+	}
+	return Role(role), err
+}
@@ -0,0 +1,129 @@
+package throttle
+
+import (
+	"database/sql"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Key is one thing failures are counted against, such as an account or an
+// IP address.
+type Key struct {
+	Name string
+	// Free is how many failures are allowed before backoff starts.
+	Free int
+}
+
+// Limiter counts failed attempts in the database, so every instance sees
+// them, and backs off exponentially: the first failure beyond a key's Free
+// allowance locks it for Base, each further one doubles that up to Max.
+type Limiter struct {
+	DB   *sql.DB
+	Base time.Duration
+	Max  time.Duration
+	// Window is how long a key's failures are remembered after the last one.
+	Window time.Duration
+}
+
+// Attempt reserves an attempt against every key. If any key is locked it
+// returns how long the longest lock still lasts and records nothing.
+// Otherwise the attempt is counted as a failure up front, in the same
+// transaction as the check, so parallel attempts cannot all get past it
+// before the first failure lands. A successful attempt should then Reset or
+// Refund its keys.
+func (l *Limiter) Attempt(keys ...Key) (time.Duration, error) {
+	now := time.Now()
+	tx, err := l.DB.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// lock rows in name order so overlapping attempts cannot deadlock
+	keys = slices.SortedFunc(slices.Values(keys), func(a, b Key) int { return strings.Compare(a.Name, b.Name) })
+	counts := make([]int, len(keys))
+	var wait time.Duration
+	for i, k := range keys {
+		var failures int
+		var last time.Time
+		var until sql.NullTime
+		// the no-op update takes the row lock
+		err := tx.QueryRow(`
+			INSERT INTO auth_failures (key, failures, last_failure_at) VALUES ($1, 0, $2)
+			ON CONFLICT (key) DO UPDATE SET failures = auth_failures.failures
+			RETURNING failures, last_failure_at, locked_until`, k.Name, now).Scan(&failures, &last, &until)
+		if err != nil {
+			return 0, err
+		}
+		if d := until.Time.Sub(now); until.Valid && d > wait {
+			wait = d
+		}
+		if last.Before(now.Add(-l.Window)) {
+			failures = 0
+		}
+		counts[i] = failures + 1
+	}
+	if wait > 0 {
+		return wait, nil
+	}
+	for i, k := range keys {
+		var until sql.NullTime
+		if lock := l.backoff(counts[i] - k.Free); lock > 0 {
+			until = sql.NullTime{Time: now.Add(lock), Valid: true}
+		}
+		if _, err := tx.Exec(`UPDATE auth_failures SET failures=$1, last_failure_at=$2, locked_until=$3 WHERE key=$4`, counts[i], now, until, k.Name); err != nil {
+			return 0, err
+		}
+	}
+	return 0, tx.Commit()
+}
+
+// Refund takes back an attempt that did not fail from keys a success should
+// not Reset, such as an IP shared by many accounts. The key's lock is lifted
+// once it is back within its allowance.
+func (l *Limiter) Refund(keys ...Key) error {
+	for _, k := range keys {
+		_, err := l.DB.Exec(`
+			UPDATE auth_failures SET failures = failures - 1,
+				locked_until = CASE WHEN failures - 1 > $2 THEN locked_until END
+			WHERE key=$1 AND failures > 0`, k.Name, k.Free)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Reset forgets the failures of keys after a successful attempt, and drops
+// keys nobody has failed for a while.
+func (l *Limiter) Reset(keys ...Key) error {
+	for _, k := range keys {
+		if _, err := l.DB.Exec(`DELETE FROM auth_failures WHERE key=$1`, k.Name); err != nil {
+			return err
+		}
+	}
+	now := time.Now()
+	_, err := l.DB.Exec(`DELETE FROM auth_failures WHERE last_failure_at < $1 AND (locked_until IS NULL OR locked_until < $2)`, now.Add(-l.Window), now)
+	return err
+}
+
+// backoff is the lock after the n-th failure beyond the free ones.
+func (l *Limiter) backoff(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	lock := l.Base
+	for i := 1; i < n && lock < l.Max; i++ {
+		lock *= 2
+	}
+	if lock > l.Max {
+		lock = l.Max
+	}
+	return lock
+}
+
+// Seconds rounds a wait up to whole seconds for a Retry-After header.
+func Seconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
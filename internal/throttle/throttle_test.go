@@ -0,0 +1,136 @@
+package throttle
+
+import (
+	"database/sql"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// newTestLimiter returns a limiter on a throwaway SQLite database.
+func newTestLimiter(t *testing.T) *Limiter {
+	t.Helper()
+	dsn := filepath.Join(t.TempDir(), "throttle.db") + "?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := db.Exec(`CREATE TABLE auth_failures (key TEXT PRIMARY KEY, failures INT NOT NULL DEFAULT 0,
+		last_failure_at TIMESTAMP NOT NULL, locked_until TIMESTAMP)`); err != nil {
+		t.Fatal(err)
+	}
+	return &Limiter{DB: db, Base: time.Minute, Max: time.Hour, Window: time.Hour}
+}
+
+// TestAttemptParallel lets exactly Free+1 of many simultaneous attempts
+// through: the one beyond the allowance still runs and locks the key.
+func TestAttemptParallel(t *testing.T) {
+	l := newTestLimiter(t)
+	key := Key{Name: "login:alice", Free: 3}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			wait, err := l.Attempt(key)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if wait == 0 {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if allowed != key.Free+1 {
+		t.Fatalf("%d attempts allowed, want %d", allowed, key.Free+1)
+	}
+}
+
+// TestBackoff covers the base lock, doubling and the Max cap.
+func TestBackoff(t *testing.T) {
+	l := &Limiter{Base: 30 * time.Second, Max: 5 * time.Minute}
+	for _, tc := range []struct {
+		n    int
+		want time.Duration
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{4, 4 * time.Minute},
+		{5, 5 * time.Minute},
+		{6, 5 * time.Minute},
+		{100, 5 * time.Minute},
+	} {
+		if got := l.backoff(tc.n); got != tc.want {
+			t.Errorf("backoff(%d) = %v, want %v", tc.n, got, tc.want)
+		}
+	}
+}
+
+// TestAttemptFree locks a key only once its failures exceed Free.
+func TestAttemptFree(t *testing.T) {
+	for _, free := range []int{0, 1, 5} {
+		l := newTestLimiter(t)
+		key := Key{Name: "ip:10.0.0.1", Free: free}
+		for i := 1; i <= free+1; i++ {
+			if wait, err := l.Attempt(key); err != nil || wait != 0 {
+				t.Fatalf("free %d: attempt %d blocked for %v (%v)", free, i, wait, err)
+			}
+		}
+		wait, err := l.Attempt(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if wait <= 0 || wait > l.Base {
+			t.Fatalf("free %d: attempt %d waits %v, want up to %v", free, free+2, wait, l.Base)
+		}
+	}
+}
+
+// TestResetAfterSuccess clears a locked key, and Refund hands back an
+// attempt without forgetting earlier failures.
+func TestResetAfterSuccess(t *testing.T) {
+	l := newTestLimiter(t)
+	account := Key{Name: "login:alice", Free: 1}
+	ip := Key{Name: "ip:10.0.0.1", Free: 1}
+
+	for i := 0; i < 2; i++ {
+		if _, err := l.Attempt(account, ip); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if wait, _ := l.Attempt(account); wait == 0 {
+		t.Fatal("account not locked after its free failures")
+	}
+
+	if err := l.Reset(account); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.Refund(ip); err != nil {
+		t.Fatal(err)
+	}
+	var n int
+	if err := l.DB.QueryRow(`SELECT COUNT(1) FROM auth_failures WHERE key=$1`, account.Name).Scan(&n); err != nil || n != 0 {
+		t.Fatalf("reset left %d rows (%v)", n, err)
+	}
+	if wait, err := l.Attempt(account, ip); err != nil || wait != 0 {
+		t.Fatalf("attempt after reset waits %v (%v)", wait, err)
+	}
+	// the refund only took back one of the ip's two failures
+	if wait, _ := l.Attempt(ip); wait == 0 {
+		t.Fatal("ip not locked by its remaining failures")
+	}
+}
@@ -0,0 +1,57 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// rfcSecret is the SHA1 key of the RFC 6238 test vectors, base32 encoded.
+const rfcSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+// TestCodeRFC6238 checks the RFC 6238 appendix B vectors, cut to six digits.
+func TestCodeRFC6238(t *testing.T) {
+	for _, tc := range []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	} {
+		at := time.Unix(tc.unix, 0)
+		got, err := Code(rfcSecret, Step(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tc.want {
+			t.Errorf("Code at %d = %s, want %s", tc.unix, got, tc.want)
+		}
+		if step, ok := Match(rfcSecret, tc.want, at, 0); !ok || step != Step(at) {
+			t.Errorf("Match at %d = %d, %v, want %d, true", tc.unix, step, ok, Step(at))
+		}
+	}
+}
+
+// TestMatchWindow accepts codes one step either side of now and no further.
+func TestMatchWindow(t *testing.T) {
+	now := time.Unix(1234567890, 0)
+	for d := int64(-2); d <= 2; d++ {
+		code, err := Code(rfcSecret, Step(now)+d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		step, ok := Match(rfcSecret, code, now, 1)
+		if want := d >= -1 && d <= 1; ok != want {
+			t.Errorf("step %+d: matched %v, want %v", d, ok, want)
+		}
+		if ok && step != Step(now)+d {
+			t.Errorf("step %+d: matched step %d, want %d", d, step, Step(now)+d)
+		}
+	}
+	if _, ok := Match(rfcSecret, "12345", now, 1); ok {
+		t.Error("matched a code of the wrong length")
+	}
+}
@@ -10,16 +10,21 @@ import (
 	"github.com/ageniuscoder/mmchat/backend/internal/config"
 	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
 	"github.com/ageniuscoder/mmchat/backend/internal/otp"
+	"github.com/ageniuscoder/mmchat/backend/internal/throttle"
 	"github.com/ageniuscoder/mmchat/backend/internal/utils"
 	"github.com/gin-gonic/gin"
 	"github.com/go-playground/validator/v10"
 )
 
 type Service struct {
-	DB        *sql.DB
-	JWTSecret string
-	JWTTTLMin int
-	OTP       otp.Service
+	DB       *sql.DB
+	Sessions *auth.Sessions
+	OTP      otp.Service
+	// Limiter backs off repeated failures; accountFree and ipFree are the
+	// failures allowed per account (or email) and per IP before it does.
+	Limiter     *throttle.Limiter
+	accountFree int
+	ipFree      int
 }
 
 // ✅ Updated to use email
@@ -34,11 +39,18 @@ type signupVerifyReq struct {
 	Email    string `json:"email" binding:"required,email"`
 	Password string `json:"password" binding:"required"`
 	OTP      string `json:"otp" binding:"required"`
+	// DeviceName labels the new session in GET /sessions.
+	DeviceName string `json:"device_name" binding:"max=100"`
+	// ReturnTokens also puts the tokens in the response body, for clients
+	// without a cookie jar.
+	ReturnTokens bool `json:"return_tokens"`
 }
 
 type loginReq struct {
-	Username string `json:"username" binding:"required"`
-	Password string `json:"password" binding:"required"`
+	Username     string `json:"username" binding:"required"`
+	Password     string `json:"password" binding:"required"`
+	DeviceName   string `json:"device_name" binding:"max=100"`
+	ReturnTokens bool   `json:"return_tokens"`
 }
 
 type forgotInitReq struct {
@@ -51,24 +63,38 @@ type forgotCompleteReq struct {
 	NewPassword string `json:"new_password" binding:"required"`
 }
 
-func RegisterPublic(rg *gin.RouterGroup, db *sql.DB, cfg config.Config) {
-	s := Service{
-		DB:        db,
-		JWTSecret: cfg.JWTSecret,
-		JWTTTLMin: cfg.JWTTTLMin,
+func newService(db *sql.DB, cfg config.Config, sessions *auth.Sessions) Service {
+	return Service{
+		DB:       db,
+		Sessions: sessions,
 		OTP: otp.Service{
 			DB:             db,
 			Digits:         cfg.OTPDigits,
 			TTL:            time.Duration(cfg.OTPTTLSec) * time.Second,
 			SendGridAPIKey: cfg.SendGridAPIKey,
 			SendGridFrom:   cfg.SendGridFrom,
+			MaxAttempts:    cfg.OTPMaxAttempts,
+		},
+		Limiter: &throttle.Limiter{
+			DB:     db,
+			Base:   time.Duration(cfg.LockoutBaseSec) * time.Second,
+			Max:    time.Duration(cfg.LockoutMaxSec) * time.Second,
+			Window: time.Duration(cfg.LockoutMaxSec) * time.Second,
 		},
+		accountFree: cfg.LoginMaxFailures,
+		ipFree:      cfg.IPMaxFailures,
 	}
+}
+
+func RegisterPublic(rg *gin.RouterGroup, db *sql.DB, cfg config.Config, sessions *auth.Sessions) {
+	s := newService(db, cfg, sessions)
 
 	rg.POST("/signup/initiate", s.signupInitiate)
 	rg.POST("/signup/verify", s.signupVerify)
 	rg.POST("/login", s.login)
+	rg.POST("/login/2fa", s.loginTwoFactor)
 	rg.POST("/logout", s.logout)
+	rg.POST("/refresh", s.refresh)
 	rg.POST("/forgot/initiate", s.forgotInitiate)
 	rg.POST("/forgot/reset", s.forgotComplete)
 }
@@ -112,11 +138,20 @@ func (s Service) signupVerify(c *gin.Context) {
 		return
 	}
 
+	keys := []throttle.Key{s.accountKey("otp:signup", req.Email), s.ipKey(c)}
+	if s.throttled(c, keys...) {
+		return
+	}
 	ok, err := s.OTP.Verify(req.Email, "signup", req.OTP)
 	if err != nil || !ok {
+		if err != nil {
+			s.refunded(keys...)
+		}
 		httpx.Err(c, 422, "Invalid Otp")
 		return
 	}
+	s.succeeded(keys[0])
+	s.refunded(keys[1])
 	hash, _ := auth.HashPassword(req.Password)
 
 	var uid int64
@@ -126,24 +161,18 @@ func (s Service) signupVerify(c *gin.Context) {
 		return
 	}
 
-	tok, err := auth.NewToken(s.JWTSecret, uid, s.JWTTTLMin)
+	t, err := s.startSession(c, uid, req.DeviceName)
 	if err != nil {
+		fmt.Println("session start error:", err)
 		httpx.Err(c, http.StatusInternalServerError, "Token Generation Failed")
 		return
 	}
 
-	// IMPORTANT: Use http.SetCookie to set SameSite=None for cross-origin requests
-	http.SetCookie(c.Writer, &http.Cookie{
-		Name:     "token",
-		Value:    tok,
-		MaxAge:   s.JWTTTLMin * 60,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteNoneMode,
-	})
-
-	httpx.OK(c, gin.H{"success": true, "user_id": uid})
+	resp := gin.H{"success": true, "user_id": uid}
+	if req.ReturnTokens {
+		s.addTokens(resp, t)
+	}
+	httpx.OK(c, resp)
 }
 
 func (s Service) login(c *gin.Context) {
@@ -157,6 +186,12 @@ func (s Service) login(c *gin.Context) {
 		return
 	}
 
+	// unknown usernames count too, so lockouts do not reveal which exist
+	keys := []throttle.Key{s.accountKey("login", req.Username), s.ipKey(c)}
+	if s.throttled(c, keys...) {
+		return
+	}
+
 	row := s.DB.QueryRow(`SELECT id, password_hash FROM users WHERE username=$1`, req.Username)
 
 	var id int64
@@ -170,33 +205,65 @@ func (s Service) login(c *gin.Context) {
 		httpx.Err(c, http.StatusBadRequest, "Invalid Credentials")
 		return
 	}
-	tok, _ := auth.NewToken(s.JWTSecret, id, s.JWTTTLMin)
+	s.succeeded(keys[0])
+	s.refunded(keys[1])
+
+	// with 2FA on, the password only earns a challenge for POST /login/2fa
+	enabled, err := twoFactorEnabled(s.DB, id)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if enabled {
+		challenge, err := s.newChallenge(id, req.DeviceName, req.ReturnTokens)
+		if err != nil {
+			fmt.Println("login challenge error:", err)
+			httpx.Err(c, http.StatusInternalServerError, "Token Generation Failed")
+			return
+		}
+		httpx.OK(c, gin.H{
+			"success":             true,
+			"two_factor_required": true,
+			"challenge_token":     challenge,
+			"expires_in":          int(challengeTTL / time.Second),
+		})
+		return
+	}
 
-	// IMPORTANT: Use http.SetCookie to set SameSite=None for cross-origin requests
-	http.SetCookie(c.Writer, &http.Cookie{
-		Name:     "token",
-		Value:    tok,
-		MaxAge:   s.JWTTTLMin * 60,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteNoneMode,
-	})
+	t, err := s.startSession(c, id, req.DeviceName)
+	if err != nil {
+		fmt.Println("session start error:", err)
+		httpx.Err(c, http.StatusInternalServerError, "Token Generation Failed")
+		return
+	}
 
-	httpx.OK(c, gin.H{"success": true, "user_id": id})
+	resp := gin.H{"success": true, "user_id": id}
+	if req.ReturnTokens {
+		s.addTokens(resp, t)
+	}
+	httpx.OK(c, resp)
 }
 
+// logout ends the caller's session, found through the refresh token or,
+// failing that, a still valid access token.
 func (s Service) logout(c *gin.Context) {
-	// Correctly clear the cookie with SameSite=None
-	http.SetCookie(c.Writer, &http.Cookie{
-		Name:     "token",
-		Value:    "",
-		MaxAge:   -1,
-		Path:     "/",
-		HttpOnly: true,
-		Secure:   true,
-		SameSite: http.SameSiteNoneMode,
-	})
+	var uid, sid int64
+	if refresh, _, err := refreshTokenOf(c); err == nil && refresh != "" {
+		uid, sid, _ = s.Sessions.SessionOf(refresh)
+	}
+	if sid == 0 {
+		if tok, _ := auth.AccessToken(c, s.Sessions.Sources); tok != "" {
+			if claims, err := auth.ParseToken(s.Sessions.Secret, tok); err == nil {
+				uid, sid = claims.UserId, claims.SessionID
+			}
+		}
+	}
+	if sid != 0 {
+		if _, err := s.Sessions.Revoke(uid, sid); err != nil {
+			fmt.Println("session revoke error:", err)
+		}
+	}
+	clearAuthCookies(c)
 	httpx.OK(c, gin.H{"success": true, "message": "Logged out successfully"})
 }
 
@@ -232,17 +299,34 @@ func (s Service) forgotComplete(c *gin.Context) {
 	}
 
 	// Verify OTP and update password
+	keys := []throttle.Key{s.accountKey("otp:reset", req.Email), s.ipKey(c)}
+	if s.throttled(c, keys...) {
+		return
+	}
 	ok, err := s.OTP.Verify(req.Email, "reset", req.OTP)
 	if err != nil || !ok {
+		if err != nil {
+			s.refunded(keys...)
+		}
 		httpx.Err(c, http.StatusUnprocessableEntity, "Invalid Otp")
 		return
 	}
+	s.succeeded(keys[0])
+	s.refunded(keys[1])
 
 	hash, _ := auth.HashPassword(req.NewPassword)
-	_, err = s.DB.Exec(`UPDATE users SET password_hash=$1 WHERE email=$2`, hash, req.Email)
-	if err != nil {
+	var uid int64
+	err = s.DB.QueryRow(`UPDATE users SET password_hash=$1 WHERE email=$2 RETURNING id`, hash, req.Email).Scan(&uid)
+	if err != nil && err != sql.ErrNoRows {
 		httpx.Err(c, http.StatusInternalServerError, "Update Password Failed")
 		return
 	}
+	// whoever knew the old password must not stay signed in
+	if uid != 0 {
+		if _, err := s.Sessions.RevokeAll(uid); err != nil {
+			fmt.Printf("failed to revoke sessions of user %d after password reset: %v\n", uid, err)
+		}
+	}
+	clearAuthCookies(c)
 	httpx.OK(c, gin.H{"success": true, "message": "password updated"})
 }
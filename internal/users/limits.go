@@ -0,0 +1,57 @@
+package users
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/throttle"
+	"github.com/gin-gonic/gin"
+)
+
+// accountKey counts failures against one account or email, e.g.
+// accountKey("login", "alice") or accountKey("otp:reset", email).
+func (s Service) accountKey(kind, id string) throttle.Key {
+	return throttle.Key{Name: kind + ":" + strings.ToLower(id), Free: s.accountFree}
+}
+
+// ipKey counts failures from the caller's address across all accounts.
+func (s Service) ipKey(c *gin.Context) throttle.Key {
+	return throttle.Key{Name: "ip:" + c.ClientIP(), Free: s.ipFree}
+}
+
+// throttled reserves an attempt against keys and answers 429 with
+// Retry-After while any of them is locked. The attempt counts as failed
+// unless the caller reports it with succeeded or refunded.
+func (s Service) throttled(c *gin.Context, keys ...throttle.Key) bool {
+	wait, err := s.Limiter.Attempt(keys...)
+	if err != nil {
+		// fail open: a limiter outage must not lock everybody out
+		fmt.Println("limiter check error:", err)
+		return false
+	}
+	if wait <= 0 {
+		return false
+	}
+	secs := throttle.Seconds(wait)
+	c.Header("Retry-After", strconv.Itoa(secs))
+	httpx.Err(c, http.StatusTooManyRequests, fmt.Sprintf("too many failed attempts, try again in %d seconds", secs))
+	return true
+}
+
+// succeeded forgets the failures of keys after a successful attempt.
+func (s Service) succeeded(keys ...throttle.Key) {
+	if err := s.Limiter.Reset(keys...); err != nil {
+		fmt.Println("limiter reset error:", err)
+	}
+}
+
+// refunded takes back an attempt against keys that did not fail, because it
+// succeeded or never got to check a credential.
+func (s Service) refunded(keys ...throttle.Key) {
+	if err := s.Limiter.Refund(keys...); err != nil {
+		fmt.Println("limiter refund error:", err)
+	}
+}
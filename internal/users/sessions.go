@@ -0,0 +1,214 @@
+package users
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/config"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/gin-gonic/gin"
+)
+
+// refreshCookie holds the refresh token. It is only sent to /api so it does
+// not travel with every asset request.
+const refreshCookie = "refresh_token"
+
+// Register wires the session and two-factor management routes; they need
+// an authenticated user.
+func Register(rg *gin.RouterGroup, db *sql.DB, cfg config.Config, sessions *auth.Sessions) {
+	s := newService(db, cfg, sessions)
+	rg.GET("/sessions", s.listSessions)
+	rg.DELETE("/sessions/:id", s.revokeSession)
+
+	rg.GET("/2fa", s.twoFactorStatus)
+	rg.POST("/2fa/enroll", s.enrollTwoFactor)
+	rg.POST("/2fa/confirm", s.confirmTwoFactor)
+	rg.POST("/2fa/disable", s.disableTwoFactor)
+	rg.POST("/2fa/recovery-codes", s.regenerateRecoveryCodes)
+}
+
+func device(c *gin.Context, name string) auth.Device {
+	ua := c.Request.UserAgent()
+	if len(ua) > 512 {
+		ua = ua[:512]
+	}
+	return auth.Device{Name: name, IP: c.ClientIP(), UserAgent: ua}
+}
+
+// startSession opens a session for a freshly authenticated user and sets
+// its cookies.
+func (s Service) startSession(c *gin.Context, uid int64, deviceName string) (auth.Tokens, error) {
+	t, err := s.Sessions.Create(uid, device(c, deviceName))
+	if err != nil {
+		return auth.Tokens{}, err
+	}
+	s.setAuthCookies(c, t)
+	return t, nil
+}
+
+// addTokens puts t into a response body for clients that send the access
+// token as "Authorization: Bearer" rather than keep cookies.
+func (s Service) addTokens(resp gin.H, t auth.Tokens) {
+	resp["access_token"] = t.Access
+	resp["refresh_token"] = t.Refresh
+	resp["token_type"] = "Bearer"
+	resp["expires_in"] = int(s.Sessions.AccessTTL / time.Second)
+}
+
+type refreshReq struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// refreshTokenOf reads the refresh token from the JSON body, falling back to
+// the cookie. fromBody tells the caller to answer with tokens in the body.
+func refreshTokenOf(c *gin.Context) (token string, fromBody bool, err error) {
+	var req refreshReq
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			return "", false, err
+		}
+	}
+	if req.RefreshToken != "" {
+		return req.RefreshToken, true, nil
+	}
+	token, _ = c.Cookie(refreshCookie)
+	return token, false, nil
+}
+
+// IMPORTANT: Use http.SetCookie to set SameSite=None for cross-origin requests
+func (s Service) setAuthCookies(c *gin.Context, t auth.Tokens) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     "token",
+		Value:    t.Access,
+		MaxAge:   int(s.Sessions.AccessTTL / time.Second),
+		Path:     "/",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     refreshCookie,
+		Value:    t.Refresh,
+		MaxAge:   int(s.Sessions.RefreshTTL / time.Second),
+		Path:     "/api",
+		HttpOnly: true,
+		Secure:   true,
+		SameSite: http.SameSiteNoneMode,
+	})
+}
+
+func clearAuthCookies(c *gin.Context) {
+	for name, path := range map[string]string{"token": "/", refreshCookie: "/api"} {
+		http.SetCookie(c.Writer, &http.Cookie{
+			Name:     name,
+			Value:    "",
+			MaxAge:   -1,
+			Path:     path,
+			HttpOnly: true,
+			Secure:   true,
+			SameSite: http.SameSiteNoneMode,
+		})
+	}
+}
+
+// refresh rotates the refresh token and issues a new access token for the
+// same session.
+func (s Service) refresh(c *gin.Context) {
+	refresh, fromBody, err := refreshTokenOf(c)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if refresh == "" {
+		httpx.Err(c, http.StatusUnauthorized, "missing refresh token")
+		return
+	}
+	uid, t, err := s.Sessions.Rotate(refresh, device(c, ""))
+	switch {
+	case errors.Is(err, auth.ErrRefreshReused):
+		fmt.Printf("refresh token reused for session %d of user %d, session revoked\n", t.SessionID, uid)
+		clearAuthCookies(c)
+		httpx.Err(c, http.StatusUnauthorized, "refresh token already used, session revoked")
+		return
+	case errors.Is(err, auth.ErrInvalidRefresh), errors.Is(err, auth.ErrSessionEnded):
+		clearAuthCookies(c)
+		httpx.Err(c, http.StatusUnauthorized, "session expired, please log in again")
+		return
+	case err != nil:
+		fmt.Println("refresh error:", err)
+		httpx.Err(c, http.StatusInternalServerError, "Token Generation Failed")
+		return
+	}
+	s.setAuthCookies(c, t)
+	resp := gin.H{"success": true, "user_id": uid}
+	if fromBody {
+		s.addTokens(resp, t)
+	}
+	httpx.OK(c, resp)
+}
+
+// listSessions returns the caller's active sessions, most recently used
+// first.
+func (s Service) listSessions(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	current, _ := auth.SessionIDFromContext(c)
+	rows, err := s.DB.Query(`
+		SELECT id, device_name, ip, user_agent, created_at, last_used_at
+		FROM sessions
+		WHERE user_id=$1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY last_used_at DESC`, uid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	defer rows.Close()
+
+	sessions := []gin.H{}
+	for rows.Next() {
+		var id int64
+		var name, ip, ua string
+		var createdAt, lastUsedAt time.Time
+		if err := rows.Scan(&id, &name, &ip, &ua, &createdAt, &lastUsedAt); err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "database error")
+			return
+		}
+		sessions = append(sessions, gin.H{
+			"id":           id,
+			"device_name":  name,
+			"ip":           ip,
+			"user_agent":   ua,
+			"created_at":   createdAt.UTC().Format(time.RFC3339),
+			"last_used_at": lastUsedAt.UTC().Format(time.RFC3339),
+			"current":      id == current,
+		})
+	}
+	httpx.OK(c, gin.H{"sessions": sessions})
+}
+
+// revokeSession signs one of the caller's devices out.
+func (s Service) revokeSession(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	sid, err := strconv.ParseInt(c.Param("id"), 10, 64)
+	if err != nil {
+		httpx.Err(c, http.StatusBadRequest, "invalid session id")
+		return
+	}
+	ok, err := s.Sessions.Revoke(uid, sid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "revoke failed")
+		return
+	}
+	if !ok {
+		httpx.Err(c, http.StatusNotFound, "session not found")
+		return
+	}
+	if current, _ := auth.SessionIDFromContext(c); current == sid {
+		clearAuthCookies(c)
+	}
+	httpx.OK(c, gin.H{"success": true, "session_id": sid})
+}
@@ -0,0 +1,528 @@
+package users
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/auth"
+	"github.com/ageniuscoder/mmchat/backend/internal/httpx"
+	"github.com/ageniuscoder/mmchat/backend/internal/throttle"
+	"github.com/ageniuscoder/mmchat/backend/internal/totp"
+	"github.com/ageniuscoder/mmchat/backend/internal/utils"
+	"github.com/gin-gonic/gin"
+	"github.com/go-playground/validator/v10"
+)
+
+const (
+	totpIssuer = "MmChat"
+	// totpSkew accepts codes one step either side of now for clock drift.
+	totpSkew          = 1
+	recoveryCodeCount = 10
+	// challengeTTL and challengeAttempts bound the second login step.
+	challengeTTL      = 5 * time.Minute
+	challengeAttempts = 5
+)
+
+// recoveryAlphabet leaves out characters that are easily confused.
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+type querier interface {
+	Exec(query string, args ...any) (sql.Result, error)
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+type totpCodeReq struct {
+	Code string `json:"code" binding:"required"`
+}
+
+// secondFactorReq carries either a TOTP code or a recovery code.
+type secondFactorReq struct {
+	Code         string `json:"code"`
+	RecoveryCode string `json:"recovery_code"`
+}
+
+type loginTwoFactorReq struct {
+	ChallengeToken string `json:"challenge_token" binding:"required"`
+	secondFactorReq
+}
+
+type disableTwoFactorReq struct {
+	Password string `json:"password" binding:"required"`
+	secondFactorReq
+}
+
+func bindJSON(c *gin.Context, req any) bool {
+	if err := c.ShouldBindJSON(req); err != nil {
+		if validationErrors, ok := err.(validator.ValidationErrors); ok {
+			httpx.Err(c, http.StatusBadRequest, utils.ValidationErr(validationErrors))
+			return false
+		}
+		httpx.Err(c, http.StatusBadRequest, err.Error())
+		return false
+	}
+	return true
+}
+
+// twoFactorEnabled reports whether uid has a confirmed TOTP secret.
+func twoFactorEnabled(q querier, uid int64) (bool, error) {
+	var enabled bool
+	err := q.QueryRow(`SELECT confirmed_at IS NOT NULL FROM user_totp WHERE user_id=$1`, uid).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	return enabled, err
+}
+
+// checkTOTP accepts a code for uid's confirmed secret at most once.
+func checkTOTP(q querier, uid int64, code string) (bool, error) {
+	var secret string
+	var lastStep int64
+	err := q.QueryRow(`SELECT secret, last_step FROM user_totp WHERE user_id=$1 AND confirmed_at IS NOT NULL`, uid).Scan(&secret, &lastStep)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	step, ok := totp.Match(secret, code, time.Now(), totpSkew)
+	if !ok || step <= lastStep {
+		return false, nil
+	}
+	res, err := q.Exec(`UPDATE user_totp SET last_step=$1 WHERE user_id=$2 AND last_step < $1`, step, uid)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// useRecoveryCode spends one of uid's unused recovery codes.
+func useRecoveryCode(q querier, uid int64, code string) (bool, error) {
+	res, err := q.Exec(`UPDATE recovery_codes SET used_at=CURRENT_TIMESTAMP WHERE user_id=$1 AND code_hash=$2 AND used_at IS NULL`, uid, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// check verifies whichever of the TOTP or recovery code was supplied.
+func (r secondFactorReq) check(q querier, uid int64) (bool, error) {
+	if r.Code != "" {
+		return checkTOTP(q, uid, r.Code)
+	}
+	if r.RecoveryCode != "" {
+		return useRecoveryCode(q, uid, r.RecoveryCode)
+	}
+	return false, nil
+}
+
+// twoFactorKey counts wrong codes against uid across challenges and the
+// management endpoints.
+func (s Service) twoFactorKey(uid int64) throttle.Key {
+	return s.accountKey("2fa", strconv.FormatInt(uid, 10))
+}
+
+func (r secondFactorReq) empty() bool { return r.Code == "" && r.RecoveryCode == "" }
+
+// newRecoveryCodes replaces uid's recovery codes and returns the new ones;
+// only their hashes are stored.
+func newRecoveryCodes(q querier, uid int64) ([]string, error) {
+	if _, err := q.Exec(`DELETE FROM recovery_codes WHERE user_id=$1`, uid); err != nil {
+		return nil, err
+	}
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 10)
+		for j := range b {
+			n, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryAlphabet))))
+			if err != nil {
+				return nil, err
+			}
+			b[j] = recoveryAlphabet[n.Int64()]
+		}
+		codes[i] = string(b[:5]) + "-" + string(b[5:])
+		if _, err := q.Exec(`INSERT INTO recovery_codes (user_id, code_hash) VALUES ($1, $2)`, uid, hashToken(string(b))); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	return strings.NewReplacer("-", "", " ", "").Replace(code)
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// twoFactorStatus reports whether 2FA is on and how many recovery codes are
+// left.
+func (s Service) twoFactorStatus(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	var enabled, pending bool
+	err := s.DB.QueryRow(`SELECT confirmed_at IS NOT NULL, confirmed_at IS NULL FROM user_totp WHERE user_id=$1`, uid).Scan(&enabled, &pending)
+	if err != nil && err != sql.ErrNoRows {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	var left int
+	if enabled {
+		if err := s.DB.QueryRow(`SELECT COUNT(1) FROM recovery_codes WHERE user_id=$1 AND used_at IS NULL`, uid).Scan(&left); err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "database error")
+			return
+		}
+	}
+	httpx.OK(c, gin.H{"enabled": enabled, "pending": pending, "recovery_codes_left": left})
+}
+
+// enrollTwoFactor starts (or restarts) enrollment with a fresh secret. 2FA
+// is only enforced once a code from it is confirmed.
+func (s Service) enrollTwoFactor(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	tx, err := s.DB.Begin()
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "db transaction failed")
+		return
+	}
+	defer tx.Rollback()
+
+	enabled, err := twoFactorEnabled(tx, uid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if enabled {
+		httpx.Err(c, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+	var username string
+	if err := tx.QueryRow(`SELECT username FROM users WHERE id=$1`, uid).Scan(&username); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	secret, err := totp.NewSecret()
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "secret generation failed")
+		return
+	}
+	_, err = tx.Exec(`
+		INSERT INTO user_totp (user_id, secret) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret=EXCLUDED.secret, confirmed_at=NULL, last_step=0, created_at=NOW()`, uid, secret)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "enroll failed")
+		return
+	}
+	codes, err := newRecoveryCodes(tx, uid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "enroll failed")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "commit failed")
+		return
+	}
+	httpx.OK(c, gin.H{
+		"secret":         secret,
+		"otpauth_uri":    totp.URI(totpIssuer, username, secret),
+		"recovery_codes": codes,
+	})
+}
+
+// confirmTwoFactor turns 2FA on once the user proves their app works.
+func (s Service) confirmTwoFactor(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	var req totpCodeReq
+	if !bindJSON(c, &req) {
+		return
+	}
+	var secret string
+	var confirmed bool
+	err := s.DB.QueryRow(`SELECT secret, confirmed_at IS NOT NULL FROM user_totp WHERE user_id=$1`, uid).Scan(&secret, &confirmed)
+	if err == sql.ErrNoRows {
+		httpx.Err(c, http.StatusBadRequest, "no two-factor enrollment in progress")
+		return
+	}
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if confirmed {
+		httpx.Err(c, http.StatusConflict, "two-factor authentication is already enabled")
+		return
+	}
+	key := s.twoFactorKey(uid)
+	if s.throttled(c, key) {
+		return
+	}
+	step, ok := totp.Match(secret, req.Code, time.Now(), totpSkew)
+	if !ok {
+		httpx.Err(c, http.StatusBadRequest, "invalid code")
+		return
+	}
+	s.succeeded(key)
+	res, err := s.DB.Exec(`UPDATE user_totp SET confirmed_at=NOW(), last_step=$1 WHERE user_id=$2 AND secret=$3 AND confirmed_at IS NULL`, step, uid, secret)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "update failed")
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		httpx.Err(c, http.StatusConflict, "enrollment changed, try again")
+		return
+	}
+	httpx.OK(c, gin.H{"success": true, "enabled": true})
+}
+
+// disableTwoFactor needs the password and a second factor, so a stolen
+// session alone cannot turn 2FA off.
+func (s Service) disableTwoFactor(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	var req disableTwoFactorReq
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.empty() {
+		httpx.Err(c, http.StatusBadRequest, "code or recovery_code is required")
+		return
+	}
+	key := s.twoFactorKey(uid)
+	if s.throttled(c, key) {
+		return
+	}
+	var hash string
+	if err := s.DB.QueryRow(`SELECT password_hash FROM users WHERE id=$1`, uid).Scan(&hash); err != nil {
+		s.refunded(key)
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if err := auth.CheckPassword(hash, req.Password); err != nil {
+		httpx.Err(c, http.StatusBadRequest, "Invalid Credentials")
+		return
+	}
+
+	tx, err := s.DB.Begin()
+	if err != nil {
+		s.refunded(key)
+		httpx.Err(c, http.StatusInternalServerError, "db transaction failed")
+		return
+	}
+	defer tx.Rollback()
+	ok, err := req.check(tx, uid)
+	if err != nil {
+		s.refunded(key)
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if !ok {
+		httpx.Err(c, http.StatusBadRequest, "invalid code")
+		return
+	}
+	s.succeeded(key)
+	for _, q := range []string{
+		`DELETE FROM user_totp WHERE user_id=$1`,
+		`DELETE FROM recovery_codes WHERE user_id=$1`,
+		`DELETE FROM login_challenges WHERE user_id=$1`,
+	} {
+		if _, err := tx.Exec(q, uid); err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "disable failed")
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "commit failed")
+		return
+	}
+	httpx.OK(c, gin.H{"success": true, "enabled": false})
+}
+
+// regenerateRecoveryCodes replaces every recovery code, used or not.
+func (s Service) regenerateRecoveryCodes(c *gin.Context) {
+	uid := auth.MustUserID(c)
+	var req totpCodeReq
+	if !bindJSON(c, &req) {
+		return
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "db transaction failed")
+		return
+	}
+	defer tx.Rollback()
+
+	enabled, err := twoFactorEnabled(tx, uid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if !enabled {
+		httpx.Err(c, http.StatusBadRequest, "two-factor authentication is not enabled")
+		return
+	}
+	key := s.twoFactorKey(uid)
+	if s.throttled(c, key) {
+		return
+	}
+	ok, err := checkTOTP(tx, uid, req.Code)
+	if err != nil {
+		s.refunded(key)
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if !ok {
+		httpx.Err(c, http.StatusBadRequest, "invalid code")
+		return
+	}
+	s.succeeded(key)
+	codes, err := newRecoveryCodes(tx, uid)
+	if err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "regenerate failed")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "commit failed")
+		return
+	}
+	httpx.OK(c, gin.H{"recovery_codes": codes})
+}
+
+// newChallenge is issued instead of a session when the password was right
+// but a second factor is still owed.
+func (s Service) newChallenge(uid int64, deviceName string, returnTokens bool) (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	if _, err := s.DB.Exec(`DELETE FROM login_challenges WHERE expires_at < $1`, time.Now()); err != nil {
+		return "", err
+	}
+	_, err := s.DB.Exec(`
+		INSERT INTO login_challenges (user_id, token_hash, device_name, return_tokens, expires_at)
+		VALUES ($1, $2, $3, $4, $5)`, uid, hashToken(token), deviceName, returnTokens, time.Now().Add(challengeTTL))
+	return token, err
+}
+
+// loginChallenge is an outstanding second login step.
+type loginChallenge struct {
+	id           int64
+	userID       int64
+	deviceName   string
+	returnTokens bool
+	// attempts includes the one being made
+	attempts int
+}
+
+// takeChallenge counts an attempt against the live challenge for token and
+// keeps it locked until q's transaction ends. Unknown, expired and used up
+// challenges give sql.ErrNoRows.
+func takeChallenge(q querier, token string, now time.Time) (loginChallenge, error) {
+	var ch loginChallenge
+	err := q.QueryRow(`
+		UPDATE login_challenges SET attempts=attempts+1
+		WHERE token_hash=$1 AND expires_at > $2 AND attempts < $3
+		RETURNING id, user_id, device_name, return_tokens, attempts`,
+		hashToken(token), now, challengeAttempts).Scan(&ch.id, &ch.userID, &ch.deviceName, &ch.returnTokens, &ch.attempts)
+	return ch, err
+}
+
+// endChallenge deletes a challenge once it is redeemed or used up.
+func endChallenge(q querier, id int64) error {
+	_, err := q.Exec(`DELETE FROM login_challenges WHERE id=$1`, id)
+	return err
+}
+
+// loginTwoFactor completes a login with a TOTP or recovery code. A
+// challenge dies after challengeAttempts wrong codes.
+func (s Service) loginTwoFactor(c *gin.Context) {
+	var req loginTwoFactorReq
+	if !bindJSON(c, &req) {
+		return
+	}
+	if req.empty() {
+		httpx.Err(c, http.StatusBadRequest, "code or recovery_code is required")
+		return
+	}
+	ip := s.ipKey(c)
+	if s.throttled(c, ip) {
+		return
+	}
+	tx, err := s.DB.Begin()
+	if err != nil {
+		s.refunded(ip)
+		httpx.Err(c, http.StatusInternalServerError, "db transaction failed")
+		return
+	}
+	defer tx.Rollback()
+
+	ch, err := takeChallenge(tx, req.ChallengeToken, time.Now())
+	if err == sql.ErrNoRows {
+		httpx.Err(c, http.StatusUnauthorized, "login challenge expired, please log in again")
+		return
+	}
+	if err != nil {
+		s.refunded(ip)
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	uid := ch.userID
+	// per account too, since a password holder can keep opening challenges
+	key := s.twoFactorKey(uid)
+	if s.throttled(c, key) {
+		s.refunded(ip)
+		return
+	}
+	ok, err := req.check(tx, uid)
+	if err != nil {
+		s.refunded(key, ip)
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if !ok {
+		if ch.attempts >= challengeAttempts {
+			err = endChallenge(tx, ch.id)
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			httpx.Err(c, http.StatusInternalServerError, "database error")
+			return
+		}
+		httpx.Err(c, http.StatusUnauthorized, "invalid code")
+		return
+	}
+	s.succeeded(key)
+	s.refunded(ip)
+	if err := endChallenge(tx, ch.id); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "database error")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		httpx.Err(c, http.StatusInternalServerError, "commit failed")
+		return
+	}
+
+	t, err := s.startSession(c, uid, ch.deviceName)
+	if err != nil {
+		fmt.Println("session start error:", err)
+		httpx.Err(c, http.StatusInternalServerError, "Token Generation Failed")
+		return
+	}
+	resp := gin.H{"success": true, "user_id": uid}
+	if ch.returnTokens {
+		s.addTokens(resp, t)
+	}
+	httpx.OK(c, resp)
+}
@@ -0,0 +1,164 @@
+package users
+
+import (
+	"database/sql"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ageniuscoder/mmchat/backend/internal/totp"
+	_ "modernc.org/sqlite"
+)
+
+// newTestDB opens a throwaway SQLite database with the two-factor tables.
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "users.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	for _, st := range []string{
+		`CREATE TABLE user_totp (user_id INTEGER PRIMARY KEY, secret TEXT NOT NULL, confirmed_at TIMESTAMP, last_step BIGINT NOT NULL DEFAULT 0)`,
+		`CREATE TABLE recovery_codes (id INTEGER PRIMARY KEY, user_id BIGINT NOT NULL, code_hash TEXT NOT NULL, used_at TIMESTAMP)`,
+		`CREATE TABLE login_challenges (id INTEGER PRIMARY KEY, user_id BIGINT NOT NULL, token_hash TEXT NOT NULL UNIQUE,
+			device_name TEXT NOT NULL DEFAULT '', return_tokens BOOLEAN NOT NULL DEFAULT FALSE,
+			attempts INT NOT NULL DEFAULT 0, expires_at TIMESTAMP NOT NULL)`,
+	} {
+		if _, err := db.Exec(st); err != nil {
+			t.Fatalf("%s: %v", st, err)
+		}
+	}
+	return db
+}
+
+// TestCheckTOTPRejectsReplay accepts a code once and refuses it, or any
+// code of an earlier step, afterwards.
+func TestCheckTOTPRejectsReplay(t *testing.T) {
+	db := newTestDB(t)
+	secret, err := totp.NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO user_totp (user_id, secret, confirmed_at) VALUES (1, $1, CURRENT_TIMESTAMP)`, secret); err != nil {
+		t.Fatal(err)
+	}
+	step := totp.Step(time.Now())
+	current, _ := totp.Code(secret, step)
+	previous, _ := totp.Code(secret, step-1)
+
+	if ok, err := checkTOTP(db, 1, current); err != nil || !ok {
+		t.Fatalf("first use: %v, %v", ok, err)
+	}
+	if ok, err := checkTOTP(db, 1, current); err != nil || ok {
+		t.Fatalf("replayed code accepted: %v, %v", ok, err)
+	}
+	if ok, err := checkTOTP(db, 1, previous); err != nil || ok {
+		t.Fatalf("code of an earlier step accepted: %v, %v", ok, err)
+	}
+	if ok, err := checkTOTP(db, 2, current); err != nil || ok {
+		t.Fatalf("code accepted for a user without 2FA: %v, %v", ok, err)
+	}
+}
+
+// TestRecoveryCodeSingleUse spends each recovery code at most once.
+func TestRecoveryCodeSingleUse(t *testing.T) {
+	db := newTestDB(t)
+	codes, err := newRecoveryCodes(db, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(codes) != recoveryCodeCount {
+		t.Fatalf("got %d codes, want %d", len(codes), recoveryCodeCount)
+	}
+
+	// typed with a space for the dash and in upper case it is the same code
+	typed := strings.ToUpper(codes[0][:5] + " " + codes[0][6:])
+	for _, tc := range []struct {
+		user int64
+		code string
+		want bool
+	}{
+		{2, codes[0], false},
+		{1, typed, true},
+		{1, codes[0], false},
+		{1, codes[1], true},
+		{1, "aaaaa-aaaaa", false},
+	} {
+		ok, err := useRecoveryCode(db, tc.user, tc.code)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.want {
+			t.Fatalf("user %d code %q: got %v, want %v", tc.user, tc.code, ok, tc.want)
+		}
+	}
+
+	// regenerating invalidates the old codes
+	if _, err := newRecoveryCodes(db, 1); err != nil {
+		t.Fatal(err)
+	}
+	if ok, _ := useRecoveryCode(db, 1, codes[2]); ok {
+		t.Fatal("old code accepted after regeneration")
+	}
+}
+
+// TestLoginChallenge checks that a challenge cannot be redeemed twice,
+// after it expired or once its attempts are used up.
+func TestLoginChallenge(t *testing.T) {
+	db := newTestDB(t)
+	s := Service{DB: db}
+	take := func(token string) (loginChallenge, error) {
+		return takeChallenge(db, token, time.Now())
+	}
+
+	token, err := s.newChallenge(1, "phone", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch, err := take(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ch.userID != 1 || ch.deviceName != "phone" || !ch.returnTokens || ch.attempts != 1 {
+		t.Fatalf("unexpected challenge %+v", ch)
+	}
+	if err := endChallenge(db, ch.id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := take(token); err != sql.ErrNoRows {
+		t.Fatalf("redeemed challenge: got %v, want sql.ErrNoRows", err)
+	}
+	if _, err := take("not-a-token"); err != sql.ErrNoRows {
+		t.Fatalf("unknown challenge: got %v, want sql.ErrNoRows", err)
+	}
+
+	expired, err := s.newChallenge(1, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`UPDATE login_challenges SET expires_at=$1 WHERE token_hash=$2`, time.Now().Add(-time.Second), hashToken(expired)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := take(expired); err != sql.ErrNoRows {
+		t.Fatalf("expired challenge: got %v, want sql.ErrNoRows", err)
+	}
+
+	guessed, err := s.newChallenge(1, "", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= challengeAttempts; i++ {
+		ch, err := take(guessed)
+		if err != nil {
+			t.Fatalf("attempt %d: %v", i, err)
+		}
+		if ch.attempts != i {
+			t.Fatalf("attempt %d counted as %d", i, ch.attempts)
+		}
+	}
+	if _, err := take(guessed); err != sql.ErrNoRows {
+		t.Fatalf("attempt %d: got %v, want sql.ErrNoRows", challengeAttempts+1, err)
+	}
+}
@@ -0,0 +1,2 @@
+ALTER TABLE messages ADD COLUMN client_message_id TEXT;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_client_id ON messages(sender_id, client_message_id);
@@ -0,0 +1,9 @@
+ALTER TABLE users ADD COLUMN event_seq BIGINT NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS user_events (
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, seq)
+);
+CREATE INDEX IF NOT EXISTS idx_user_events_created ON user_events(created_at);
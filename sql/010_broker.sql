@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS broker_nodes (
+    node_id TEXT PRIMARY KEY,
+    heartbeat_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+CREATE TABLE IF NOT EXISTS broker_presence (
+    node_id TEXT NOT NULL REFERENCES broker_nodes(node_id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (node_id, user_id)
+);
+CREATE INDEX IF NOT EXISTS idx_broker_presence_user ON broker_presence(user_id);
+CREATE TABLE IF NOT EXISTS broker_spill (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
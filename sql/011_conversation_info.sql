@@ -0,0 +1,2 @@
+ALTER TABLE conversations ADD COLUMN description TEXT;
+ALTER TABLE conversations ADD COLUMN avatar TEXT;
@@ -0,0 +1,33 @@
+ALTER TABLE participants ADD COLUMN role TEXT NOT NULL DEFAULT 'member'
+    CHECK (role IN ('owner','admin','moderator','member','read_only'));
+UPDATE participants SET role='admin' WHERE is_admin;
+-- every group gets one owner: its earliest admin, or its earliest member if it had none
+UPDATE participants SET role='owner'
+WHERE (conversation_id, user_id) IN (
+    SELECT DISTINCT ON (p.conversation_id) p.conversation_id, p.user_id
+    FROM participants p
+    JOIN conversations c ON c.id = p.conversation_id AND c.is_group_chat
+    ORDER BY p.conversation_id, p.is_admin DESC, p.joined_at, p.user_id
+);
+ALTER TABLE participants DROP COLUMN is_admin;
+
+-- least role allowed to perform each action
+ALTER TABLE conversations ADD COLUMN perm_post TEXT NOT NULL DEFAULT 'member'
+    CHECK (perm_post IN ('owner','admin','moderator','member','read_only'));
+ALTER TABLE conversations ADD COLUMN perm_add_members TEXT NOT NULL DEFAULT 'admin'
+    CHECK (perm_add_members IN ('owner','admin','moderator','member','read_only'));
+ALTER TABLE conversations ADD COLUMN perm_edit_info TEXT NOT NULL DEFAULT 'admin'
+    CHECK (perm_edit_info IN ('owner','admin','moderator','member','read_only'));
+ALTER TABLE conversations ADD COLUMN perm_pin TEXT NOT NULL DEFAULT 'moderator'
+    CHECK (perm_pin IN ('owner','admin','moderator','member','read_only'));
+ALTER TABLE conversations ADD COLUMN perm_delete_messages TEXT NOT NULL DEFAULT 'moderator'
+    CHECK (perm_delete_messages IN ('owner','admin','moderator','member','read_only'));
+
+CREATE TABLE IF NOT EXISTS message_pins (
+    message_id BIGINT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+    conversation_id BIGINT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    pinned_by BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    pinned_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS idx_message_pins_conversation
+    ON message_pins(conversation_id, pinned_at DESC);
@@ -0,0 +1,2 @@
+ALTER TABLE conversations ADD COLUMN announcement_only BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE conversations ADD COLUMN slow_mode_sec INT NOT NULL DEFAULT 0 CHECK (slow_mode_sec >= 0);
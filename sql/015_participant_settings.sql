@@ -0,0 +1,4 @@
+ALTER TABLE participants ADD COLUMN muted_until TIMESTAMP WITH TIME ZONE;
+ALTER TABLE participants ADD COLUMN archived BOOLEAN NOT NULL DEFAULT FALSE;
+-- NULL when the conversation is not pinned
+ALTER TABLE participants ADD COLUMN pin_order INT;
@@ -0,0 +1,11 @@
+-- failed login and code attempts, keyed by account, email+purpose or IP
+CREATE TABLE IF NOT EXISTS auth_failures (
+    key TEXT PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS idx_auth_failures_last ON auth_failures(last_failure_at);
+
+-- wrong guesses against an outstanding OTP. The code is deleted at the limit.
+ALTER TABLE otp_codes ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
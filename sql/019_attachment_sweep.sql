@@ -0,0 +1,3 @@
+-- finds a user's unsent uploads and the ones old enough to sweep
+CREATE INDEX IF NOT EXISTS idx_attachments_unclaimed
+    ON attachments(uploader_id, created_at) WHERE message_id IS NULL;
@@ -1,6 +1,21 @@
 -- sql/schema.sql
 -- Drop tables in a specific order to avoid foreign key constraints issues
+DROP TABLE IF EXISTS auth_failures;
+DROP TABLE IF EXISTS login_challenges;
+DROP TABLE IF EXISTS recovery_codes;
+DROP TABLE IF EXISTS user_totp;
+DROP TABLE IF EXISTS sessions;
 DROP TABLE IF EXISTS otp_codes;
+DROP TABLE IF EXISTS user_events;
+DROP TABLE IF EXISTS conversation_invites;
+DROP TABLE IF EXISTS broker_presence;
+DROP TABLE IF EXISTS broker_nodes;
+DROP TABLE IF EXISTS broker_spill;
+DROP TABLE IF EXISTS message_pins;
+DROP TABLE IF EXISTS message_hidden;
+DROP TABLE IF EXISTS message_reactions;
+DROP TABLE IF EXISTS attachments;
+DROP TABLE IF EXISTS message_revisions;
 DROP TABLE IF EXISTS message_status;
 DROP TABLE IF EXISTS messages;
 DROP TABLE IF EXISTS participants;
@@ -15,7 +30,52 @@ CREATE TABLE IF NOT EXISTS users(
     password_hash TEXT NOT NULL,
     profile_pic TEXT,
     created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
-    last_active TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+    last_active TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    event_seq BIGINT NOT NULL DEFAULT 0
+);
+
+-- SESSIONS (one per signed-in device, refresh tokens stored hashed)
+CREATE TABLE IF NOT EXISTS sessions (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    refresh_hash TEXT NOT NULL UNIQUE,
+    prev_refresh_hash TEXT,
+    device_name TEXT NOT NULL DEFAULT '',
+    ip TEXT NOT NULL DEFAULT '',
+    user_agent TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_used_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS idx_sessions_user ON sessions(user_id);
+
+-- TWO-FACTOR (TOTP secret pending until confirmed, last_step blocks code reuse)
+CREATE TABLE IF NOT EXISTS user_totp (
+    user_id BIGINT PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret TEXT NOT NULL,
+    confirmed_at TIMESTAMP WITH TIME ZONE,
+    last_step BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS recovery_codes (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS idx_recovery_codes_user ON recovery_codes(user_id);
+
+-- issued by a password login when 2FA is on, redeemed with a code
+CREATE TABLE IF NOT EXISTS login_challenges (
+    id BIGSERIAL PRIMARY KEY,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE,
+    device_name TEXT NOT NULL DEFAULT '',
+    return_tokens BOOLEAN NOT NULL DEFAULT FALSE,
+    attempts INT NOT NULL DEFAULT 0,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
 );
 
 -- OTP CODES
@@ -25,14 +85,34 @@ CREATE TABLE IF NOT EXISTS otp_codes (
     code TEXT NOT NULL,
     purpose TEXT NOT NULL CHECK (purpose IN ('signup','reset')),
     expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
     created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
 );
 
+-- AUTH FAILURES (failed attempts per account, email+purpose or IP)
+CREATE TABLE IF NOT EXISTS auth_failures (
+    key TEXT PRIMARY KEY,
+    failures INT NOT NULL DEFAULT 0,
+    last_failure_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    locked_until TIMESTAMP WITH TIME ZONE
+);
+CREATE INDEX IF NOT EXISTS idx_auth_failures_last ON auth_failures(last_failure_at);
+
 -- CONVERSATIONS
 CREATE TABLE IF NOT EXISTS conversations (
     id BIGSERIAL PRIMARY KEY,
     name TEXT,
+    description TEXT,
+    avatar TEXT,
     is_group_chat BOOLEAN NOT NULL DEFAULT FALSE,
+    -- least role allowed to perform each action (see internal/roles)
+    perm_post TEXT NOT NULL DEFAULT 'member' CHECK (perm_post IN ('owner','admin','moderator','member','read_only')),
+    perm_add_members TEXT NOT NULL DEFAULT 'admin' CHECK (perm_add_members IN ('owner','admin','moderator','member','read_only')),
+    perm_edit_info TEXT NOT NULL DEFAULT 'admin' CHECK (perm_edit_info IN ('owner','admin','moderator','member','read_only')),
+    perm_pin TEXT NOT NULL DEFAULT 'moderator' CHECK (perm_pin IN ('owner','admin','moderator','member','read_only')),
+    perm_delete_messages TEXT NOT NULL DEFAULT 'moderator' CHECK (perm_delete_messages IN ('owner','admin','moderator','member','read_only')),
+    announcement_only BOOLEAN NOT NULL DEFAULT FALSE,
+    slow_mode_sec INT NOT NULL DEFAULT 0 CHECK (slow_mode_sec >= 0),
     created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
 );
 
@@ -40,11 +120,28 @@ CREATE TABLE IF NOT EXISTS conversations (
 CREATE TABLE IF NOT EXISTS participants (
     conversation_id BIGINT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
     user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
-    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+    role TEXT NOT NULL DEFAULT 'member' CHECK (role IN ('owner','admin','moderator','member','read_only')),
     joined_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    -- per-user settings; pin_order is NULL when not pinned
+    muted_until TIMESTAMP WITH TIME ZONE,
+    archived BOOLEAN NOT NULL DEFAULT FALSE,
+    pin_order INT,
     PRIMARY KEY (conversation_id, user_id)
 );
 
+-- CONVERSATION INVITES (shareable join links)
+CREATE TABLE IF NOT EXISTS conversation_invites (
+    id BIGSERIAL PRIMARY KEY,
+    conversation_id BIGINT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    token TEXT NOT NULL UNIQUE,
+    created_by BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    expires_at TIMESTAMP WITH TIME ZONE,
+    max_uses INT,
+    use_count INT NOT NULL DEFAULT 0,
+    revoked_at TIMESTAMP WITH TIME ZONE,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
 -- MESSAGES
 CREATE TABLE IF NOT EXISTS messages (
     id BIGSERIAL PRIMARY KEY,
@@ -53,7 +150,87 @@ CREATE TABLE IF NOT EXISTS messages (
     content TEXT NOT NULL,
     sent_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
     is_deleted BOOLEAN NOT NULL DEFAULT FALSE, -- Add this line for soft deletion
-    edited_at TIMESTAMP WITH TIME ZONE -- Add this line for message edits
+    edited_at TIMESTAMP WITH TIME ZONE, -- Add this line for message edits
+    reply_to_message_id BIGINT REFERENCES messages(id) ON DELETE SET NULL,
+    content_tsv TSVECTOR GENERATED ALWAYS AS (to_tsvector('simple', content)) STORED,
+    client_message_id TEXT
+);
+
+-- MESSAGE HIDDEN ("delete for me")
+CREATE TABLE IF NOT EXISTS message_hidden (
+    message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    hidden_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id)
+);
+
+-- MESSAGE PINS
+CREATE TABLE IF NOT EXISTS message_pins (
+    message_id BIGINT PRIMARY KEY REFERENCES messages(id) ON DELETE CASCADE,
+    conversation_id BIGINT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    pinned_by BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    pinned_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- MESSAGE REACTIONS
+CREATE TABLE IF NOT EXISTS message_reactions (
+    message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    emoji TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (message_id, user_id, emoji)
+);
+
+-- ATTACHMENTS (message_id stays NULL until the upload is sent)
+CREATE TABLE IF NOT EXISTS attachments (
+    id BIGSERIAL PRIMARY KEY,
+    conversation_id BIGINT NOT NULL REFERENCES conversations(id) ON DELETE CASCADE,
+    uploader_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    message_id BIGINT REFERENCES messages(id) ON DELETE CASCADE,
+    storage_key TEXT NOT NULL UNIQUE,
+    thumbnail_key TEXT,
+    file_name TEXT NOT NULL,
+    mime_type TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    width INT,
+    height INT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- MESSAGE REVISIONS (content replaced by each edit)
+CREATE TABLE IF NOT EXISTS message_revisions (
+    id BIGSERIAL PRIMARY KEY,
+    message_id BIGINT NOT NULL REFERENCES messages(id) ON DELETE CASCADE,
+    content TEXT NOT NULL,
+    written_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    replaced_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+-- USER EVENTS (per-user log of persisted WebSocket events, replayed on reconnect)
+CREATE TABLE IF NOT EXISTS user_events (
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    seq BIGINT NOT NULL,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, seq)
+);
+
+-- BROKER (multi-instance fan-out; only used with BROKER=postgres)
+CREATE TABLE IF NOT EXISTS broker_nodes (
+    node_id TEXT PRIMARY KEY,
+    heartbeat_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS broker_presence (
+    node_id TEXT NOT NULL REFERENCES broker_nodes(node_id) ON DELETE CASCADE,
+    user_id BIGINT NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    PRIMARY KEY (node_id, user_id)
+);
+
+CREATE TABLE IF NOT EXISTS broker_spill (
+    id BIGSERIAL PRIMARY KEY,
+    payload TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
 );
 
 -- MESSAGE STATUS
@@ -72,6 +249,15 @@ CREATE INDEX IF NOT EXISTS idx_messages_conversation_time
 CREATE INDEX IF NOT EXISTS idx_messages_sender
     ON messages(sender_id);
 
+CREATE INDEX IF NOT EXISTS idx_messages_reply_to
+    ON messages(reply_to_message_id);
+
+CREATE INDEX IF NOT EXISTS idx_messages_content_tsv
+    ON messages USING GIN (content_tsv);
+
+CREATE UNIQUE INDEX IF NOT EXISTS idx_messages_client_id
+    ON messages(sender_id, client_message_id);
+
 CREATE INDEX IF NOT EXISTS idx_participants_user
     ON participants(user_id);
 
@@ -84,5 +270,32 @@ CREATE INDEX IF NOT EXISTS idx_message_status_user
 CREATE INDEX IF NOT EXISTS idx_message_status_message
     ON message_status(message_id);
 
+CREATE INDEX IF NOT EXISTS idx_message_hidden_user
+    ON message_hidden(user_id);
+
+CREATE INDEX IF NOT EXISTS idx_message_reactions_message
+    ON message_reactions(message_id);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_message
+    ON attachments(message_id);
+
+CREATE INDEX IF NOT EXISTS idx_attachments_unclaimed
+    ON attachments(uploader_id, created_at) WHERE message_id IS NULL;
+
+CREATE INDEX IF NOT EXISTS idx_message_revisions_message
+    ON message_revisions(message_id);
+
+CREATE INDEX IF NOT EXISTS idx_user_events_created
+    ON user_events(created_at);
+
+CREATE INDEX IF NOT EXISTS idx_broker_presence_user
+    ON broker_presence(user_id);
+
+CREATE INDEX IF NOT EXISTS idx_conversation_invites_conversation
+    ON conversation_invites(conversation_id);
+
 CREATE INDEX IF NOT EXISTS idx_conversations_is_group
-    ON conversations(is_group_chat);
\ No newline at end of file
+    ON conversations(is_group_chat);
+
+CREATE INDEX IF NOT EXISTS idx_message_pins_conversation
+    ON message_pins(conversation_id, pinned_at DESC);